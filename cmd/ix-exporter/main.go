@@ -0,0 +1,361 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"gitee.com/deep-spark/ixexporter/pkg/collector"
+	"gitee.com/deep-spark/ixexporter/pkg/logger"
+	"gitee.com/deep-spark/ixexporter/pkg/server"
+	"gitee.com/deep-spark/ixexporter/pkg/version"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/urfave/cli/v2"
+)
+
+func main() {
+	opts := &collector.Options{}
+
+	app := &cli.App{
+		Name:    "ix-exporter",
+		Usage:   "Export iluvatar data to Prometheus",
+		Version: fmt.Sprintf("%s (commit %s, %s)", version.Version, version.Commit, version.GoVersion),
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:    settingsFlag,
+				Usage:   "Exporter config file, which sets the flags not set on the command line nor by environment variable.",
+				EnvVars: []string{"IX_EXPORTER_CONFIG_FILE"},
+			},
+			&cli.Int64Flag{
+				Name:        "log-level",
+				Aliases:     []string{"l"},
+				Usage:       "Log level, 0-debug, 1-info, 2-warning, 3-error, 4-fatal(default 0)",
+				Value:       0,
+				Destination: &opts.Loglevel,
+				EnvVars:     []string{"IX_EXPORTER_LOGLEVEL"},
+			},
+			&cli.StringFlag{
+				Name:        "log-file",
+				Aliases:     []string{"f"},
+				Usage:       "Log file path name.",
+				Value:       "/tmp/log/ix-exporter.log",
+				Destination: &opts.Logfile,
+				EnvVars:     []string{"IX_EXPORTER_LOGFILE"},
+			},
+			&cli.BoolFlag{
+				Name:        "enable-kubernetes",
+				Aliases:     []string{"k"},
+				Usage:       "Enable Kubernetes mode.",
+				Value:       true,
+				Destination: &opts.EnableKube,
+				EnvVars:     []string{"IX_EXPORTER_ENABLE_KUBERNETES"},
+			},
+			&cli.StringFlag{
+				Name:        "metrics-config",
+				Aliases:     []string{"c"},
+				Usage:       "Metrics config file which contains of all fields.",
+				Value:       "/etc/ixexporter/metrics.yaml",
+				Destination: &opts.MetricsConfig,
+				EnvVars:     []string{"IX_EXPORTER_METRICS_CONFIG"},
+			},
+			&cli.StringFlag{
+				Name:        "ip",
+				Usage:       "Service IP.",
+				Value:       "0.0.0.0",
+				Destination: &opts.IP,
+				EnvVars:     []string{"IX_EXPORTER_SERVICE_IP"},
+			},
+			&cli.StringFlag{
+				Name:        "port",
+				Aliases:     []string{"p"},
+				Usage:       "Service port",
+				Value:       "32021",
+				Destination: &opts.Port,
+				EnvVars:     []string{"IX_EXPORTER_SERVICE_PORT"},
+			},
+			&cli.DurationFlag{
+				Name:        "enumeration-interval",
+				Usage:       "Interval of the GPU re-enumeration, 0 to disable.",
+				Value:       time.Minute,
+				Destination: &opts.EnumerationInterval,
+				EnvVars:     []string{"IX_EXPORTER_ENUMERATION_INTERVAL"},
+			},
+			&cli.IntFlag{
+				Name:        "collect-workers",
+				Usage:       "Number of GPUs collected concurrently.",
+				Value:       4,
+				Destination: &opts.CollectWorkers,
+				EnvVars:     []string{"IX_EXPORTER_COLLECT_WORKERS"},
+			},
+			&cli.DurationFlag{
+				Name:        "device-timeout",
+				Usage:       "Deadline of the collection of one GPU, 0 to disable.",
+				Value:       5 * time.Second,
+				Destination: &opts.DeviceTimeout,
+				EnvVars:     []string{"IX_EXPORTER_DEVICE_TIMEOUT"},
+			},
+			&cli.StringFlag{
+				Name:        "on-read-error",
+				Usage:       "Value of a metric whose read failed, 'drop' to leave it out or 'nan' to export NaN.",
+				Value:       collector.ReadErrorDrop,
+				Destination: &opts.ReadErrorValue,
+				EnvVars:     []string{"IX_EXPORTER_ON_READ_ERROR"},
+			},
+			&cli.DurationFlag{
+				Name:        "poll-interval",
+				Usage:       "Interval at which the metrics are collected in the background, 0 to collect on scrape.",
+				Destination: &opts.PollInterval,
+				EnvVars:     []string{"IX_EXPORTER_POLL_INTERVAL"},
+			},
+			&cli.BoolFlag{
+				Name:        "sample-timestamps",
+				Usage:       "Export the gpu metrics with the time of their collection.",
+				Destination: &opts.SampleTimestamps,
+				EnvVars:     []string{"IX_EXPORTER_SAMPLE_TIMESTAMPS"},
+			},
+			&cli.DurationFlag{
+				Name:        "collect-timeout",
+				Usage:       "Timeout of a scrape, bounds the X-Prometheus-Scrape-Timeout-Seconds sent by Prometheus. It must be less than the 10s write timeout of the metrics server.",
+				Value:       9 * time.Second,
+				Destination: &opts.CollectTimeout,
+				EnvVars:     []string{"IX_EXPORTER_COLLECT_TIMEOUT"},
+			},
+			&cli.DurationFlag{
+				Name:        "min-collect-interval",
+				Usage:       "Minimum interval between two collections started by scrapes, the scrapes in between are served the last collection.",
+				Value:       time.Second,
+				Destination: &opts.MinCollectInterval,
+				EnvVars:     []string{"IX_EXPORTER_MIN_COLLECT_INTERVAL"},
+			},
+			&cli.DurationFlag{
+				Name:        "config-reload-interval",
+				Usage:       "Interval at which the metrics config and the cluster config are checked for changes to reload, 0 to reload on SIGHUP only.",
+				Value:       10 * time.Second,
+				Destination: &opts.ConfigReloadInterval,
+				EnvVars:     []string{"IX_EXPORTER_CONFIG_RELOAD_INTERVAL"},
+			},
+			&cli.StringFlag{
+				Name:        "kubelet-socket",
+				Usage:       "Pod resources socket of the kubelet.",
+				Value:       collector.DefaultKubeletSocket,
+				Destination: &opts.KubeletSocket,
+				EnvVars:     []string{"IX_EXPORTER_KUBELET_SOCKET"},
+			},
+			&cli.StringFlag{
+				Name:        "resource-name",
+				Usage:       "Kubernetes resource name of the GPUs.",
+				Value:       collector.DefaultResourceName,
+				Destination: &opts.ResourceName,
+				EnvVars:     []string{"IX_EXPORTER_RESOURCE_NAME"},
+			},
+			&cli.DurationFlag{
+				Name:        "kubernetes-timeout",
+				Usage:       "Timeout of the connection to the kubelet and of the listing of the pod resources.",
+				Value:       collector.DefaultKubeTimeout,
+				Destination: &opts.KubeTimeout,
+				EnvVars:     []string{"IX_EXPORTER_KUBERNETES_TIMEOUT"},
+			},
+			&cli.StringFlag{
+				Name:        "cluster-config",
+				Usage:       "Cluster config file of the split board flag.",
+				Value:       collector.DefaultClusterConfig,
+				Destination: &opts.ClusterConfig,
+				EnvVars:     []string{"IX_EXPORTER_CLUSTER_CONFIG"},
+			},
+			&cli.StringFlag{
+				Name:        "metric-namespace",
+				Usage:       "Prefix of the exported metric names, which replaces their 'ix' prefix.",
+				Value:       collector.DefaultNamespace,
+				Destination: &opts.MetricNamespace,
+				EnvVars:     []string{"IX_EXPORTER_METRIC_NAMESPACE"},
+			},
+			&cli.StringFlag{
+				Name:        "metric-naming",
+				Usage:       "Naming of the gpu metrics, 'legacy', 'conventional' for the Prometheus conventions with base units, or 'compat' for both.",
+				Value:       collector.NamingLegacy,
+				Destination: &opts.MetricNaming,
+				EnvVars:     []string{"IX_EXPORTER_METRIC_NAMING"},
+			},
+			&cli.StringFlag{
+				Name:        "const-labels",
+				Usage:       "Constant labels added to every exported metric, e.g. 'cluster=a,datacenter=b,rack=c'.",
+				Destination: &opts.ConstLabels,
+				EnvVars:     []string{"IX_EXPORTER_CONST_LABELS"},
+			},
+			&cli.StringFlag{
+				Name:        "simulate",
+				Usage:       "Scenario file of simulated GPUs, IXML is not used when set.",
+				Destination: &opts.SimulateConfig,
+				EnvVars:     []string{"IX_EXPORTER_SIMULATE"},
+			},
+			&cli.StringFlag{
+				Name:        "replay",
+				Usage:       "Fixture file recorded by 'ix-exporter record', IXML is not used when set.",
+				Destination: &opts.ReplayFile,
+				EnvVars:     []string{"IX_EXPORTER_REPLAY"},
+			},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:  "record",
+				Usage: "Record the IXML queries of the device enumeration and the metrics collection into a fixture file",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "output",
+						Aliases: []string{"o"},
+						Usage:   "Fixture file to write.",
+						Value:   "ix-exporter-fixture.yaml",
+					},
+					&cli.IntFlag{
+						Name:  "cycles",
+						Usage: "Number of collection cycles to record.",
+						Value: 3,
+					},
+					&cli.DurationFlag{
+						Name:  "interval",
+						Usage: "Interval between two collection cycles.",
+						Value: 5 * time.Second,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if err := logger.InitIluvatarLog(opts.Logfile, opts.Loglevel); err != nil {
+						return err
+					}
+					return collector.Record(opts, c.String("output"), c.Int("cycles"), c.Duration("interval"))
+				},
+			},
+			{
+				Name:  "config",
+				Usage: "Check the metrics config or print the effective configuration",
+				Subcommands: []*cli.Command{
+					{
+						Name:      "validate",
+						Usage:     "Validate a metrics config file without initializing IXML, the errors are printed with their line",
+						ArgsUsage: "<file>",
+						Action: func(c *cli.Context) error {
+							if c.NArg() != 1 {
+								return fmt.Errorf("expect one metrics config file, got %d arguments", c.NArg())
+							}
+							if err := logger.InitIluvatarLog(opts.Logfile, opts.Loglevel); err != nil {
+								return err
+							}
+							// The errors are returned and printed once, rather than logged too.
+							logger.IluvatarLog.SetOutput(io.Discard)
+							opts.MetricsConfig = c.Args().First()
+							opts.MetricsEmbedded = false
+							if err := collector.ValidateConfig(opts, newRegistry()); err != nil {
+								return err
+							}
+							fmt.Printf("%s: OK\n", opts.MetricsConfig)
+							return nil
+						},
+					},
+					{
+						Name:  "print",
+						Usage: "Print the effective configuration from the flags, the environment, the exporter config file and the defaults, as an exporter config file",
+						Action: func(c *cli.Context) error {
+							if err := logger.InitIluvatarLog(opts.Logfile, opts.Loglevel); err != nil {
+								return err
+							}
+							logger.IluvatarLog.SetOutput(io.Discard)
+							return printSettings(c, opts)
+						},
+					},
+				},
+			},
+		},
+		Before: func(c *cli.Context) error {
+			return applySettings(c, opts)
+		},
+		Action: func(c *cli.Context) error {
+			return run(opts)
+		},
+	}
+
+	if err := app.Run(os.Args); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func run(opts *collector.Options) error {
+	if err := logger.InitIluvatarLog(opts.Logfile, opts.Loglevel); err != nil {
+		return err
+	}
+	logger.IluvatarLog.Infof("ix-exporter %s (commit %s, %s)", version.Version, version.Commit, version.GoVersion)
+
+	ixCollector, err := collector.NewIluvatarCollector(opts)
+	if err != nil {
+		return err
+	}
+
+	// ixCollector is registered by the server for every scrape, with the timeout
+	// of the scrape.
+	ixCollector.Start()
+	defer ixCollector.Shutdown()
+
+	// The descriptors are checked once here, so that a metrics config which renames
+	// a metric to a taken name fails at start rather than at every scrape.
+	reg := newRegistry()
+	if err = ixCollector.Check(reg); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for sig := range sigs {
+			if sig == syscall.SIGHUP {
+				logger.IluvatarLog.Infof("Received signal %v, reloading config", sig)
+				ixCollector.Reload(reg)
+				continue
+			}
+			logger.IluvatarLog.Infof("Received signal %v, exiting", sig)
+			cancel()
+			return
+		}
+	}()
+
+	if opts.ConfigReloadInterval > 0 {
+		ixCollector.WatchConfig(ctx, reg, opts.ConfigReloadInterval)
+	}
+
+	server.NewMetricsServer(opts, reg, ixCollector).Run(ctx, cancel)
+	return nil
+}
+
+// newRegistry returns the registry of the metrics exported besides those of the
+// iluvatar collector.
+func newRegistry() *prometheus.Registry {
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+	return reg
+}
@@ -0,0 +1,159 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// runMainEnv makes the test binary run main instead of the tests, so that the
+// tests check the exit code and the output of a command.
+const runMainEnv = "IX_EXPORTER_TEST_RUN_MAIN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runMainEnv) == "1" {
+		os.Args = append([]string{"ix-exporter"}, os.Args[1:]...)
+		main()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// runExporter runs ix-exporter with the arguments and the environment, without the
+// IX_EXPORTER_ variables of the test environment.
+func runExporter(t *testing.T, env []string, args ...string) (string, string, int) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], args...)
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, "IX_EXPORTER_") {
+			cmd.Env = append(cmd.Env, v)
+		}
+	}
+	cmd.Env = append(cmd.Env, runMainEnv+"=1")
+	cmd.Env = append(cmd.Env, env...)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	err := cmd.Run()
+	var exitErr *exec.ExitError
+	if err != nil && !errors.As(err, &exitErr) {
+		t.Fatalf("run ix-exporter: %v", err)
+	}
+	return stdout.String(), stderr.String(), cmd.ProcessState.ExitCode()
+}
+
+// writeFile writes the data to the file of a temporary directory, and returns its
+// path.
+func writeFile(t *testing.T, name, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigValidate(t *testing.T) {
+	invalid := writeFile(t, "invalid.yaml", `iluvatar:
+  metrics:
+  - name: ix_temperature
+    help: The temperature.
+    intervall: 5m
+  - name: ix_temprature
+    help: The temperature.
+  - name: ix_temperature
+    help: The temperature.
+`)
+	renamed := writeFile(t, "renamed.yaml", `iluvatar:
+  metrics:
+  - name: ix_temperature
+    help: The temperature.
+    rename: ix_power_usage
+  - name: ix_power_usage
+    help: The power usage.
+`)
+
+	tests := []struct {
+		name   string
+		args   []string
+		code   int
+		stdout string
+		stderr []string
+	}{
+		{
+			name:   "valid",
+			args:   []string{"config", "validate", "../../etc/metrics.yaml"},
+			stdout: "../../etc/metrics.yaml: OK\n",
+		},
+		{
+			name: "invalid",
+			args: []string{"config", "validate", invalid},
+			code: 1,
+			stderr: []string{
+				"line 5: field intervall not found",
+				"line 6: unknown metric 'ix_temprature'",
+				"line 8: duplicate metric 'ix_temperature', first at line 3",
+			},
+		},
+		{
+			name:   "name taken",
+			args:   []string{"config", "validate", renamed},
+			code:   1,
+			stderr: []string{"ix_power_usage"},
+		},
+		{
+			name:   "missing file",
+			args:   []string{"config", "validate", filepath.Join(t.TempDir(), "missing.yaml")},
+			code:   1,
+			stderr: []string{"file not found"},
+		},
+		{
+			name:   "no file",
+			args:   []string{"config", "validate"},
+			code:   1,
+			stderr: []string{"expect one metrics config file, got 0 arguments"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stdout, stderr, code := runExporter(t, nil, tt.args...)
+			if code != tt.code {
+				t.Fatalf("got exit code %d, want %d, stderr:\n%s", code, tt.code, stderr)
+			}
+			if tt.stdout != "" && stdout != tt.stdout {
+				t.Errorf("got output %q, want %q", stdout, tt.stdout)
+			}
+			lines := strings.Split(strings.TrimSpace(stderr), "\n")
+			if len(tt.stderr) > 1 && len(lines) != len(tt.stderr) {
+				t.Fatalf("got errors %q, want %q", lines, tt.stderr)
+			}
+			for i, want := range tt.stderr {
+				if !strings.Contains(lines[min(i, len(lines)-1)], want) {
+					t.Errorf("error %d: got %q, want %q", i, lines[min(i, len(lines)-1)], want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"gitee.com/deep-spark/ixexporter/pkg/collector"
+	"gitee.com/deep-spark/ixexporter/pkg/config"
+	"github.com/urfave/cli/v2"
+)
+
+// settingsFlag is the flag of the exporter config file.
+const settingsFlag = "config-file"
+
+// settingNames returns the flags which can be set in the exporter config file, in
+// the order of the app.
+func settingNames(app *cli.App) []string {
+	var names []string
+	for _, flag := range app.Flags {
+		name := flag.Names()[0]
+		switch name {
+		case settingsFlag, "help", "version":
+			continue
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// applySettings sets the flags of the exporter config file which are set neither
+// on the command line nor by environment variable, so that a flag is taken from
+// the command line, the environment, the file and its default in this order.
+func applySettings(c *cli.Context, opts *collector.Options) error {
+	path := c.String(settingsFlag)
+	if path == "" {
+		return nil
+	}
+
+	names := settingNames(c.App)
+	settings, err := config.ParseSettings(path, names)
+	if err != nil {
+		return fmt.Errorf("invalid exporter config file '%s':\n%v", path, err)
+	}
+
+	// The values of the file are kept to tell the settings changed on reload.
+	opts.ConfigFile = path
+	opts.SettingNames = names
+	opts.Settings = make(map[string]string)
+	for _, name := range names {
+		if !c.IsSet(name) {
+			opts.Settings[name] = ""
+		}
+	}
+
+	var errs []error
+	for _, setting := range settings.Values {
+		if c.IsSet(setting.Name) {
+			continue
+		}
+		opts.Settings[setting.Name] = setting.Value
+		if err := c.Set(setting.Name, setting.Value); err != nil {
+			errs = append(errs, fmt.Errorf("line %d: invalid value '%s' of '%s': %v",
+				setting.Line, setting.Value, setting.Name, err))
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("invalid exporter config file '%s':\n%v", path, errors.Join(errs...))
+	}
+
+	// The metrics config of the file is used unless a metrics config file is set.
+	if settings.HasMetrics && !c.IsSet(config.MetricsConfigSetting) {
+		opts.MetricsConfig = path
+		opts.MetricsEmbedded = true
+	}
+	return nil
+}
+
+// printSettings prints the effective value of every flag and the metrics config,
+// as an exporter config file.
+func printSettings(c *cli.Context, opts *collector.Options) error {
+	names := settingNames(c.App)
+	values := make(map[string]interface{}, len(names))
+	for _, name := range names {
+		value := c.Value(name)
+		if d, ok := value.(time.Duration); ok {
+			value = d.String()
+		}
+		values[name] = value
+	}
+
+	// The metrics config is printed in the file, where it excludes a metrics config
+	// file.
+	names = without(names, config.MetricsConfigSetting)
+	metrics, err := collector.LoadMetricsConfig(opts)
+	if err != nil {
+		return err
+	}
+
+	data, err := config.FormatSettings(names, values, metrics, opts.MetricsConfig)
+	if err != nil {
+		return err
+	}
+	_, err = os.Stdout.Write(data)
+	return err
+}
+
+func without(values []string, value string) []string {
+	var result []string
+	for _, v := range values {
+		if v != value {
+			result = append(result, v)
+		}
+	}
+	return result
+}
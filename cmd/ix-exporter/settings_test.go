@@ -0,0 +1,217 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+var update = flag.Bool("update", false, "update the golden files of testdata")
+
+// printedSettings runs config print and returns the settings printed.
+func printedSettings(t *testing.T, env []string, args ...string) map[string]interface{} {
+	t.Helper()
+	stdout, stderr, code := runExporter(t, env, append(args, "config", "print")...)
+	if code != 0 {
+		t.Fatalf("config print: exit code %d, stderr:\n%s", code, stderr)
+	}
+
+	settings := make(map[string]interface{})
+	if err := yaml.Unmarshal([]byte(stdout), &settings); err != nil {
+		t.Fatalf("config print output: %v\n%s", err, stdout)
+	}
+	return settings
+}
+
+func TestSettingsPrecedence(t *testing.T) {
+	metricsConfig := filepath.Join("..", "..", "etc", "metrics.yaml")
+	file := writeFile(t, "ix-exporter.yaml", `version: v1
+port: "9000"
+collect-timeout: 5s
+enable-kubernetes: false
+on-read-error: nan
+`)
+
+	tests := []struct {
+		name string
+		args []string
+		env  []string
+		want map[string]string
+	}{
+		{
+			name: "default",
+			args: []string{"-c", metricsConfig},
+			want: map[string]string{"port": "32021", "collect-timeout": "9s", "enable-kubernetes": "true",
+				"on-read-error": "drop"},
+		},
+		{
+			name: "file",
+			args: []string{"--config-file", file, "-c", metricsConfig},
+			want: map[string]string{"port": "9000", "collect-timeout": "5s", "enable-kubernetes": "false",
+				"on-read-error": "nan"},
+		},
+		{
+			name: "file by environment",
+			args: []string{"-c", metricsConfig},
+			env:  []string{"IX_EXPORTER_CONFIG_FILE=" + file},
+			want: map[string]string{"port": "9000", "collect-timeout": "5s", "enable-kubernetes": "false",
+				"on-read-error": "nan"},
+		},
+		{
+			name: "environment over file",
+			args: []string{"--config-file", file, "-c", metricsConfig},
+			env: []string{"IX_EXPORTER_SERVICE_PORT=9100", "IX_EXPORTER_COLLECT_TIMEOUT=6s",
+				"IX_EXPORTER_ENABLE_KUBERNETES=true"},
+			want: map[string]string{"port": "9100", "collect-timeout": "6s", "enable-kubernetes": "true",
+				"on-read-error": "nan"},
+		},
+		{
+			name: "flag over environment and file",
+			args: []string{"--config-file", file, "-c", metricsConfig, "-p", "9200", "--collect-timeout", "7s",
+				"-k=false", "--on-read-error", "drop"},
+			env: []string{"IX_EXPORTER_SERVICE_PORT=9100", "IX_EXPORTER_COLLECT_TIMEOUT=6s",
+				"IX_EXPORTER_ENABLE_KUBERNETES=true"},
+			want: map[string]string{"port": "9200", "collect-timeout": "7s", "enable-kubernetes": "false",
+				"on-read-error": "drop"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			settings := printedSettings(t, tt.env, tt.args...)
+			for name, want := range tt.want {
+				if got := fmt.Sprint(settings[name]); got != want {
+					t.Errorf("%s: got %s, want %s", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestSettingsMetricsConfig(t *testing.T) {
+	file := writeFile(t, "ix-exporter.yaml", `version: v1
+metrics:
+  iluvatar:
+    metrics:
+    - name: ix_temperature
+      help: The temperature.
+`)
+
+	// The metrics config of the file is used unless a metrics config file is set.
+	stdout, stderr, code := runExporter(t, nil, "--config-file", file, "config", "print")
+	if code != 0 {
+		t.Fatalf("exit code %d, stderr:\n%s", code, stderr)
+	}
+	checkContains(t, stdout, "# loaded from "+file+"\n", "- name: ix_temperature\n")
+
+	metricsConfig := filepath.Join("..", "..", "etc", "metrics.yaml")
+	stdout, stderr, code = runExporter(t, nil, "--config-file", file, "-c", metricsConfig, "config", "print")
+	if code != 0 {
+		t.Fatalf("exit code %d, stderr:\n%s", code, stderr)
+	}
+	checkContains(t, stdout, "# loaded from "+metricsConfig+"\n", "- name: ix_power_usage\n")
+}
+
+func TestSettingsInvalidFile(t *testing.T) {
+	tests := []struct {
+		name   string
+		data   string
+		stderr string
+	}{
+		{
+			name:   "invalid value",
+			data:   "version: v1\nport: \"9000\"\ncollect-timeout: soon\n",
+			stderr: "line 3: invalid value 'soon' of 'collect-timeout'",
+		},
+		{
+			name:   "unknown setting",
+			data:   "version: v1\nbogus: 1\n",
+			stderr: "line 2: unknown setting 'bogus'",
+		},
+		{
+			name:   "missing version",
+			data:   "port: \"9000\"\n",
+			stderr: "missing 'version', expect 'v1'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := writeFile(t, "ix-exporter.yaml", tt.data)
+			_, stderr, code := runExporter(t, nil, "--config-file", file, "config", "print")
+			if code != 1 {
+				t.Fatalf("got exit code %d, want 1", code)
+			}
+			checkContains(t, stderr, tt.stderr)
+		})
+	}
+}
+
+// TestConfigPrint compares the output of config print with the defaults and the
+// metrics config of etc with testdata/config_print.yaml, which is written instead
+// with -update.
+func TestConfigPrint(t *testing.T) {
+	stdout, stderr, code := runExporter(t, nil, "-c", filepath.Join("..", "..", "etc", "metrics.yaml"),
+		"config", "print")
+	if code != 0 {
+		t.Fatalf("exit code %d, stderr:\n%s", code, stderr)
+	}
+
+	path := filepath.Join("testdata", "config_print.yaml")
+	if *update {
+		if err := os.WriteFile(path, []byte(stdout), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stdout != string(want) {
+		t.Errorf("config print differs from %s, got:\n%s", path, stdout)
+	}
+
+	// The output is an exporter config file which gives the same configuration.
+	printed := make(map[string]interface{})
+	if err = yaml.Unmarshal(want, &printed); err != nil {
+		t.Fatal(err)
+	}
+	file := writeFile(t, "ix-exporter.yaml", stdout)
+	if settings := printedSettings(t, nil, "--config-file", file); !reflect.DeepEqual(settings, printed) {
+		t.Errorf("config print of the printed file: got %v, want %v", settings, printed)
+	}
+}
+
+// checkContains checks that the output contains every part.
+func checkContains(t *testing.T, output string, parts ...string) {
+	t.Helper()
+	for _, part := range parts {
+		if !strings.Contains(output, part) {
+			t.Errorf("%q not found in:\n%s", part, output)
+		}
+	}
+}
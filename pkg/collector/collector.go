@@ -18,7 +18,10 @@ limitations under the License.
 package collector
 
 import (
+	"context"
 	"fmt"
+	"strconv"
+	"sync"
 	"time"
 
 	"gitee.com/deep-spark/go-ixml/pkg/ixml"
@@ -27,56 +30,72 @@ import (
 	"github.com/prometheus/client_golang/prometheus"
 )
 
+// shutdownTimeout bounds the wait for the subcollectors on exit, a collector may
+// be stuck in a hung IXML call.
+const shutdownTimeout = 10 * time.Second
+
+// MetricsWriteTimeout is the write timeout of the metrics server, the collect
+// timeout must be less so that a scrape ends before its response is cut.
+const MetricsWriteTimeout = 10 * time.Second
+
 type subCollector interface {
 	collect(ctx *ixContext)
 }
 
 type iluvatarCollector struct {
-	opts            *Options
-	collectorConfig []collectorConfig
-	resources       map[string]*prometheus.Desc
-	gpus            iluvatarGPU
-	labels          []string
-	ctx             *ixContext
+	opts        *Options
+	config      *configStore
+	inventory   *gpuInventory
+	metrics     *exporterMetrics
+	xids        *xidLog
+	labels      []string
+	ctx         *ixContext
+	backend     deviceBackend
+	reloadMutex sync.Mutex
 }
 
-func initIXMLAndCheckDrivers(info *iluvatarGPU) error {
+// metricDesc is how a gpu metric of the metrics config is exported.
+type metricDesc struct {
+	desc      *prometheus.Desc
+	valueType prometheus.ValueType
+	scale     float64
+}
+
+func initIXMLAndCheckDrivers(backend deviceBackend, info *iluvatarGPU) error {
 	var ret ixml.Return
 
-	ret = ixml.Init()
+	ret = backend.Init()
 	if ret != ixml.SUCCESS {
 		logger.IluvatarLog.Logger.Errorf("Unable to initialize IXML: %v", ret)
 		return fmt.Errorf("unable to initialize IXML: %v", ret)
 	}
 
-	info.count, ret = ixml.DeviceGetCount()
+	info.driverVersion, ret = backend.SystemGetDriverVersion()
 	if ret != ixml.SUCCESS {
-		logger.IluvatarLog.Logger.Errorln("Unable to get device count: %v", ret)
-		return fmt.Errorf("Unable to get device count: %v", ret)
+		logger.IluvatarLog.Logger.Warningf("Unable to get driver version: %v", ret)
 	}
 
-	info.driverVersion, ret = ixml.SystemGetDriverVersion()
+	info.cudaVersion, ret = backend.SystemGetCudaDriverVersion()
 	if ret != ixml.SUCCESS {
-		logger.IluvatarLog.Logger.Warningf("Unable to get driver version: %v", ret)
+		logger.IluvatarLog.Logger.Warningf("Unable to get cuda driver version: %v", ret)
 	}
 
-	info.cudaVersion, ret = ixml.SystemGetCudaDriverVersion()
+	info.ixmlVersion, ret = backend.SystemGetIXMLVersion()
 	if ret != ixml.SUCCESS {
-		logger.IluvatarLog.Logger.Warningf("Unable to get cuda driver version: %v", ret)
+		logger.IluvatarLog.Logger.Warningf("Unable to get ixml version: %v", ret)
 	}
 	return nil
 }
 
-func processDeviceAtIndex(info *iluvatarGPU, index uint, chipList []chip, chipmap map[chip]bool) error {
-	var device ixml.Device
+func processDeviceAtIndex(backend deviceBackend, info *iluvatarGPU, index uint, chipList []chip, chipmap map[chip]bool) ([]chip, error) {
 	gpu := gpuInfo{
 		index: index,
 	}
 
-	ret := ixml.DeviceGetHandleByIndex(index, &device)
+	device, ret := backend.DeviceGetHandleByIndex(index)
 	if ret != ixml.SUCCESS {
 		logger.IluvatarLog.Logger.Errorf("Unable to get device at index %d: %v", index, ret)
-		return fmt.Errorf("Unable to get device at index %d: %v", index, ret)
+		return chipList, fmt.Errorf("Unable to get device at index %d: %v", index, ret)
 	}
 
 	gpu.name, ret = device.GetName()
@@ -99,6 +118,7 @@ func processDeviceAtIndex(info *iluvatarGPU, index uint, chipList []chip, chipma
 		}
 	} else {
 		logger.IluvatarLog.Logger.Infof("GPU %s on board %d.\n", gpu.name, pos)
+		gpu.boardPosition = strconv.FormatUint(uint64(pos), 10)
 		key := chip{
 			uuid:      uuid,
 			operation: device,
@@ -108,36 +128,97 @@ func processDeviceAtIndex(info *iluvatarGPU, index uint, chipList []chip, chipma
 		chipList = append(chipList, key)
 	}
 
+	getDeviceIdentity(device, &gpu)
+
 	info.gpus[uuid] = gpu
-	return nil
+	return chipList, nil
+}
+
+// getDeviceIdentity reads the static identity of the device exported by ix_device_info.
+func getDeviceIdentity(device gpuDevice, gpu *gpuInfo) {
+	var ret ixml.Return
+
+	warn := func(field string, ret ixml.Return) {
+		if ret == ixml.ERROR_NOT_SUPPORTED {
+			logger.IluvatarLog.Logger.Infof("GPU %s not support %s", gpu.name, field)
+		} else {
+			logger.IluvatarLog.Logger.Warningf("Unable to get %s of GPU %s: %v", field, gpu.name, ret)
+		}
+	}
+
+	if gpu.pciBusId, ret = device.GetPciBusId(); ret != ixml.SUCCESS {
+		warn("pci bus id", ret)
+	}
+	if gpu.serial, ret = device.GetSerial(); ret != ixml.SUCCESS {
+		warn("serial", ret)
+	}
+	if gpu.boardPartNumber, ret = device.GetBoardPartNumber(); ret != ixml.SUCCESS {
+		warn("board part number", ret)
+	}
+	if gpu.vbiosVersion, ret = device.GetVbiosVersion(); ret != ixml.SUCCESS {
+		warn("vbios version", ret)
+	}
+
+	mem, ret := device.GetMemoryInfo()
+	if ret != ixml.SUCCESS {
+		warn("memory info", ret)
+	} else {
+		gpu.memoryTotal = float64(mem.total)
+	}
 }
 
-func collectChipData(info *iluvatarGPU, chipmap map[chip]bool) []chip {
+func collectChipData(backend deviceBackend, info *iluvatarGPU, chipmap map[chip]bool) []chip {
 	var chipList []chip
 
 	for index := uint(0); index < info.count; index++ {
-		if err := processDeviceAtIndex(info, index, chipList, chipmap); err != nil {
-			break
-		}
+		// A device that fell off the bus must not hide the devices behind it.
+		chipList, _ = processDeviceAtIndex(backend, info, index, chipList, chipmap)
 	}
 
 	return chipList
 }
 
-func getDeviceInfo() iluvatarGPU {
+// getDeviceInfo initializes IXML and enumerates the devices. IXML is shut down
+// again if the enumeration fails, so that the caller can simply retry.
+func getDeviceInfo(backend deviceBackend) (iluvatarGPU, error) {
 	var info iluvatarGPU
 	info.pairChips = make(map[string]string)
-	chipmap := make(map[chip]bool)
 	info.gpus = make(map[string]gpuInfo)
 
-	if err := initIXMLAndCheckDrivers(&info); err != nil {
-		return info
+	if err := initIXMLAndCheckDrivers(backend, &info); err != nil {
+		return info, err
 	}
 
-	chipList := collectChipData(&info, chipmap)
+	if err := enumerateDevices(backend, &info); err != nil {
+		if ret := backend.Shutdown(); ret != ixml.SUCCESS {
+			logger.IluvatarLog.Logger.Warningf("Unable to shutdown IXML: %v", ret)
+		}
+		return info, err
+	}
+
+	info.initialized = true
+	return info, nil
+}
+
+// enumerateDevices lists the devices present and pairs the chips on the same board,
+// the gpus and pairChips of info are replaced by new maps.
+func enumerateDevices(backend deviceBackend, info *iluvatarGPU) error {
+	var ret ixml.Return
+
+	info.pairChips = make(map[string]string)
+	info.gpus = make(map[string]gpuInfo)
+	chipmap := make(map[chip]bool)
+
+	info.count, ret = backend.DeviceGetCount()
+	if ret != ixml.SUCCESS {
+		logger.IluvatarLog.Logger.Errorf("Unable to get device count: %v", ret)
+		return fmt.Errorf("Unable to get device count: %v", ret)
+	}
+
+	chipList := collectChipData(backend, info, chipmap)
 	if len(chipList) == 0 {
-		logger.IluvatarLog.Logger.Errorf("No chips detected")
-		return info
+		logger.IluvatarLog.Logger.Infof("No chips detected")
+		return nil
 	}
 	for i, first := range chipList {
 		if chipmap[first] {
@@ -145,7 +226,7 @@ func getDeviceInfo() iluvatarGPU {
 		}
 		for j := i + 1; j < len(chipList); j++ {
 			second := chipList[j]
-			onSameBoard, ret := ixml.GetOnSameBoard(first.operation, chipList[j].operation)
+			onSameBoard, ret := backend.GetOnSameBoard(first.operation, chipList[j].operation)
 			if ret != ixml.SUCCESS {
 				if ret == ixml.ERROR_NOT_SUPPORTED {
 					logger.IluvatarLog.Logger.Warningf("GetOnSameBoard: Not supported\n")
@@ -164,34 +245,92 @@ func getDeviceInfo() iluvatarGPU {
 		}
 	}
 
-	return info
+	return nil
+}
+
+// supportedMetrics returns the names of the gpu metrics the collector can collect.
+func supportedMetrics() map[string]bool {
+	names := map[string]bool{XidErrors: true}
+	for name := range metricCollectors {
+		names[name] = true
+	}
+	for name := range gpmMetrics {
+		names[name] = true
+	}
+	return names
 }
 
+// getMetricConfig returns the configs of the enabled metrics.
 func getMetricConfig(mcs config.ExporterConfig) []collectorConfig {
-	m := make([]collectorConfig, len(mcs.Metrics))
-	for i, mc := range mcs.Metrics {
-		m[i].Name = mc.Name
-		m[i].Help = mc.Help
+	var m []collectorConfig
+	for _, mc := range mcs.Metrics {
+		if !mc.IsEnabled() {
+			logger.IluvatarLog.Infof("Metric '%s' is disabled", mc.Name)
+			continue
+		}
+		cc := collectorConfig{
+			Name:        mc.Name,
+			Help:        mc.Help,
+			ExportName:  mc.ExportedName(),
+			Type:        mc.Type,
+			Scale:       mc.ScaleFactor(),
+			ConstLabels: mc.Labels,
+		}
+		// The interval is checked when the config is parsed.
+		cc.Interval, cc.OnEnumeration, _ = mc.CollectInterval()
+		m = append(m, cc)
 	}
 	return m
 }
 
-func NewIluvatarCollector(opts *Options) (*iluvatarCollector, error) {
-
+func loadExporterConfig(opts *Options) (config.ExporterConfig, error) {
 	cfg := config.Config{
 		ConfigFile: opts.MetricsConfig,
 		IxExporter: make(map[string]config.ExporterConfig),
+		Sections:   []string{Iluvatar},
+		Metrics:    supportedMetrics(),
+		Embedded:   opts.MetricsEmbedded,
 	}
 	if err := cfg.ParseConfig(); err != nil {
 		logger.IluvatarLog.Errorf("Error parsing config: %s", err)
-		return nil, err
+		return config.ExporterConfig{}, err
 	}
 	iluvatarConfig, ok := cfg.IxExporter[Iluvatar]
 	if !ok {
 		logger.IluvatarLog.Errorf("Iluvatar configuration not found")
-		return nil, fmt.Errorf("iluvatar configuration not found")
+		return config.ExporterConfig{}, fmt.Errorf("iluvatar configuration not found")
+	}
+	return iluvatarConfig, nil
+}
+
+// LoadMetricsConfig returns the metrics config of the options by section, as in a
+// metrics config file.
+func LoadMetricsConfig(opts *Options) (map[string]config.ExporterConfig, error) {
+	iluvatarConfig, err := loadExporterConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]config.ExporterConfig{Iluvatar: iluvatarConfig}, nil
+}
+
+func checkOptions(opts *Options) error {
+	switch opts.ReadErrorValue {
+	case "", ReadErrorDrop, ReadErrorNaN:
+	default:
+		return fmt.Errorf("invalid read error value '%s', expect '%s' or '%s'", opts.ReadErrorValue, ReadErrorDrop, ReadErrorNaN)
+	}
+	if opts.CollectTimeout <= 0 || opts.CollectTimeout >= MetricsWriteTimeout {
+		return fmt.Errorf("invalid collect timeout %v, expect more than 0 and less than the write timeout %v of the metrics server",
+			opts.CollectTimeout, MetricsWriteTimeout)
+	}
+	return nil
+}
+
+func NewIluvatarCollector(opts *Options) (*iluvatarCollector, error) {
+
+	if err := checkOptions(opts); err != nil {
+		return nil, err
 	}
-	ml := getMetricConfig(iluvatarConfig)
 
 	var labels []string
 	if opts.EnableKube {
@@ -200,88 +339,230 @@ func NewIluvatarCollector(opts *Options) (*iluvatarCollector, error) {
 		labels = LabelList
 	}
 
+	active, err := loadConfig(opts, labels, false)
+	if err != nil {
+		return nil, err
+	}
+
+	backend, err := newDeviceBackend(opts)
+	if err != nil {
+		logger.IluvatarLog.Errorf("Error creating device backend: %s", err)
+		return nil, err
+	}
+
+	naming, err := newMetricNaming(opts)
+	if err != nil {
+		return nil, err
+	}
+	metrics := newExporterMetrics(naming)
+	metrics.observeReload(true)
+
 	return &iluvatarCollector{
-		opts:            opts,
-		gpus:            getDeviceInfo(),
-		resources:       make(map[string]*prometheus.Desc),
-		collectorConfig: ml,
-		labels:          labels,
-		ctx:             nil,
+		opts:      opts,
+		config:    newConfigStore(active),
+		inventory: newGpuInventory(iluvatarGPU{}),
+		metrics:   metrics,
+		xids:      newXidLog(),
+		labels:    labels,
+		ctx:       nil,
+		backend:   backend,
 	}, nil
 }
 
+// Shutdown stops the subcollectors and shuts IXML down, it is called once on exit.
+func (ic *iluvatarCollector) Shutdown() {
+	if ic.ctx != nil {
+		ic.ctx.cancel()
+		if !ic.ctx.wait(shutdownTimeout) {
+			logger.IluvatarLog.Warningf("Subcollectors did not stop within %v", shutdownTimeout)
+		}
+		ic.ctx = nil
+	}
+
+	if ic.inventory.get().initialized {
+		if ret := ic.backend.Shutdown(); ret != ixml.SUCCESS {
+			logger.IluvatarLog.Warningf("Unable to shutdown IXML: %v", ret)
+			return
+		}
+		logger.IluvatarLog.Infof("IXML shut down")
+	}
+}
+
+// Start starts the subcollectors, it is called once before the first scrape. It is
+// called by Describe when the collector is registered.
+func (ic *iluvatarCollector) Start() {
+	if ic.ctx != nil {
+		return
+	}
+
+	ic.ctx = newContext()
+	ic.ctx.minInterval = ic.opts.MinCollectInterval
+	registerGpuCollector(ic.ctx, ic.config, ic.inventory, ic.backend, ic.metrics, ic.xids, ic.opts)
+	registerXidCollector(ic.ctx, ic.inventory, ic.backend, ic.metrics, ic.xids)
+	if ic.opts.EnableKube {
+		registerKubeCollector(ic.ctx, ic.config, ic.inventory, ic.metrics, ic.opts)
+	}
+	if ic.opts.PollInterval > 0 {
+		ic.ctx.startPolling(ic.opts.PollInterval)
+	}
+}
+
+// Check registers the descriptors of the collector to reg and unregisters them, it
+// returns an error if they conflict with each other or with the metrics of reg,
+// e.g. a metric renamed to a taken name.
+func (ic *iluvatarCollector) Check(reg *prometheus.Registry) error {
+	return checkConfig(reg, ic.metrics, ic.config.get())
+}
+
+func checkConfig(reg *prometheus.Registry, metrics *exporterMetrics, active *activeConfig) error {
+	check := &configCheck{metrics: metrics, resources: active.resources}
+	if err := reg.Register(check); err != nil {
+		return fmt.Errorf("invalid metric descriptors: %v", err)
+	}
+	reg.Unregister(check)
+	return nil
+}
+
+// ValidateConfig checks the metrics config of the options without initializing
+// IXML, the descriptors are checked against the metrics of reg.
+func ValidateConfig(opts *Options, reg *prometheus.Registry) error {
+	// The kubernetes labels are included, so that a constant label is checked
+	// against them too.
+	active, err := loadMetricsConfig(opts, LabelAllList)
+	if err != nil {
+		return err
+	}
+	naming, err := newMetricNaming(opts)
+	if err != nil {
+		return err
+	}
+	return checkConfig(reg, newExporterMetrics(naming), active)
+}
+
 // Describe is the implementation of the interface of 'prometheus.Collecter.Describe()', once
 // 'prometheus.MustRegtister()' or 'prometheus.Unregister()' was called, it will be triggered.
 func (ic *iluvatarCollector) Describe(ch chan<- *prometheus.Desc) {
 
 	logger.IluvatarLog.Info("Describe() called...")
 	if ic.ctx == nil {
-		ic.ctx = newContext()
-		registerGpuCollector(ic.ctx, ic.collectorConfig, ic.gpus)
-		if ic.opts.EnableKube {
-			registerKubeCollector(ic.ctx, ic.gpus)
-		}
-		for _, mc := range ic.collectorConfig {
-			var labelsForDesc []string
-			if mc.Name == ProcessInfo {
-				labelsForDesc = append(labelsForDesc, ic.labels...)
-				labelsForDesc = append(labelsForDesc, LabelProcessPid)
-				labelsForDesc = append(labelsForDesc, LabelProcessName)
-			} else {
-				labelsForDesc = ic.labels
-			}
-			desc := prometheus.NewDesc(mc.Name, mc.Help, labelsForDesc, nil)
-			ic.resources[mc.Name] = desc
-			ch <- desc
-
-			logger.IluvatarLog.Infof("Register gpu resource '%s'", mc.Name)
-		}
+		ic.Start()
+		ic.describe(ch, ic.config.get())
 	} else {
 		ic.ctx.cancel()
 		ic.ctx = nil
-		for key, _ := range ic.resources {
-			delete(ic.resources, key)
+		for key := range ic.config.get().resources {
 			logger.IluvatarLog.Infof("Unregister gpu resource '%s'", string(key))
 		}
 	}
 }
 
+func (ic *iluvatarCollector) describe(ch chan<- *prometheus.Desc, active *activeConfig) {
+	ic.metrics.describe(ch)
+	for _, descs := range active.resources {
+		for _, resource := range descs {
+			ch <- resource.desc
+		}
+	}
+}
+
 // Collect is the implementation of the interface of 'prometheus.Collector.Collect()', once
-// there is a request from client, it will be triggered, then collect the metrics.
+// there is a request from client, it will be triggered, then collect the metrics within
+// the collect timeout.
 func (ic *iluvatarCollector) Collect(ch chan<- prometheus.Metric) {
+	ctx, cancel := context.WithTimeout(context.Background(), ic.opts.CollectTimeout)
+	defer cancel()
+
+	ic.collect(ctx, ic.config.get(), ch)
+}
+
+// WithContext returns a collector which collects the metrics of ic within the
+// context, it is registered for a single scrape, whose timeout is the deadline of
+// the context. The scrape keeps the config active at its start, so that a reload
+// does not change its descriptors between Describe and Collect.
+func (ic *iluvatarCollector) WithContext(ctx context.Context) prometheus.Collector {
+	return &scrapeCollector{ic: ic, ctx: ctx, active: ic.config.get()}
+}
+
+type scrapeCollector struct {
+	ic     *iluvatarCollector
+	ctx    context.Context
+	active *activeConfig
+}
+
+func (sc *scrapeCollector) Describe(ch chan<- *prometheus.Desc) {
+	sc.ic.describe(ch, sc.active)
+}
+
+func (sc *scrapeCollector) Collect(ch chan<- prometheus.Metric) {
+	sc.ic.collect(sc.ctx, sc.active, ch)
+}
+
+// collect sends the gpu metrics of the config and the exporter metrics until the
+// context is done, the metrics sent before are the partial result of the scrape.
+// Unless polling, the gpu metrics are those of the collection the scrape started or
+// joined.
+func (ic *iluvatarCollector) collect(ctx context.Context, active *activeConfig, ch chan<- prometheus.Metric) {
 	logger.IluvatarLog.Info("Collect() called...")
-	collectMetrics := func(ch chan<- prometheus.Metric) {
-		metrics := ic.ctx.getMetrics()
-		for _, ms := range metrics {
-			for _, m := range ms {
-				labelForValues := make([]string, len(ic.labels))
-				for i, label := range ic.labels {
-					labelForValues[i] = m.labels[label]
-				}
-				if m.name == ProcessInfo {
-					labelForValues = append(labelForValues, m.labels[LabelProcessPid])
-					labelForValues = append(labelForValues, m.labels[LabelProcessName])
+	start := time.Now()
+
+	snapshot, coalesced := ic.ctx.getMetrics(ctx)
+	if coalesced {
+		ic.metrics.scrapesCoalesced.Inc()
+	}
+
+	send := func(m prometheus.Metric) bool {
+		select {
+		case ch <- m:
+			return true
+		case <-ctx.Done():
+			logger.IluvatarLog.Errorf("Collect metrics timeout after %v: %v", time.Since(start), ctx.Err())
+			ic.metrics.collectTimeouts.WithLabelValues(CollectorScrape).Inc()
+			return false
+		}
+	}
+
+	for _, ms := range snapshot.metrics {
+		for _, m := range ms {
+			labelForValues := make([]string, len(ic.labels))
+			for i, label := range ic.labels {
+				labelForValues[i] = m.labels[label]
+			}
+			for _, label := range MetricExtraLabels[m.name] {
+				labelForValues = append(labelForValues, m.labels[label])
+			}
+			for _, resource := range active.resources[m.name] {
+				constMetric := prometheus.MustNewConstMetric(resource.desc, resource.valueType,
+					m.value*resource.scale, labelForValues...)
+				if ic.opts.SampleTimestamps && snapshot.generation > 0 {
+					constMetric = prometheus.NewMetricWithTimestamp(snapshot.timestamp, constMetric)
 				}
-				if desc, ok := ic.resources[m.name]; ok {
-					ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, m.value, labelForValues...)
+				if !send(constMetric) {
+					return
 				}
 			}
 		}
 	}
+	ic.metrics.snapshotGeneration.Set(float64(snapshot.generation))
+	if snapshot.generation > 0 {
+		ic.metrics.snapshotTimestamp.Set(float64(snapshot.timestamp.UnixNano()) / 1e9)
+	}
 
-	start := time.Now()
-	done := make(chan struct{})
+	// The exporter metrics are sent through a buffer, so that no metric is sent
+	// on ch after the context is done.
+	exporterCh := make(chan prometheus.Metric, 256)
 	go func() {
-		defer close(done)
-		collectMetrics(ch)
+		defer close(exporterCh)
+		ic.metrics.collect(exporterCh)
+		ic.metrics.collectDriverInfo(exporterCh, ic.inventory.get(), active.expected)
+		ic.metrics.collectDeviceInfo(exporterCh, ic.inventory.get())
 	}()
-
-	select {
-	case <-time.After(25 * time.Second):
-		logger.IluvatarLog.Errorf("Collect metrics timeout")
-		return
-	case <-done:
-		logger.IluvatarLog.Infof("Task completed within the timeout period.")
+	for m := range exporterCh {
+		if !send(m) {
+			// Drain the buffer so that the goroutine returns.
+			for range exporterCh {
+			}
+			return
+		}
 	}
 
 	logger.IluvatarLog.Infof("Collect metrics took %v", time.Since(start))
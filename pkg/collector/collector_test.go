@@ -0,0 +1,187 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"gitee.com/deep-spark/ixexporter/pkg/logger"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var update = flag.Bool("update", false, "update the golden files of testdata/golden")
+
+func TestMain(m *testing.M) {
+	logger.IluvatarLog = logger.NewIluvatarLog()
+	logger.IluvatarLog.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// collectCycles runs the given number of collection cycles of the GPUs of the
+// options and returns the metrics of each one. The metrics config defaults to
+// testdata/metrics.yaml, the collect timeout to 1s and, unless a fixture is
+// replayed, the scenario to testdata/scenario.yaml.
+func collectCycles(t *testing.T, opts *Options, cycles int) []string {
+	t.Helper()
+	if opts.MetricsConfig == "" {
+		opts.MetricsConfig = filepath.Join("testdata", "metrics.yaml")
+	}
+	if opts.CollectTimeout == 0 {
+		opts.CollectTimeout = time.Second
+	}
+	if opts.SimulateConfig == "" && opts.ReplayFile == "" {
+		opts.SimulateConfig = filepath.Join("testdata", "scenario.yaml")
+	}
+
+	ic, err := NewIluvatarCollector(opts)
+	if err != nil {
+		t.Fatalf("NewIluvatarCollector: %v", err)
+	}
+	t.Cleanup(ic.Shutdown)
+	gc := newGpuCollector(ic.config, ic.inventory, ic.backend, ic.metrics, ic.xids, ic.opts)
+	if !gc.initialize() {
+		t.Fatal("IXML not initialized")
+	}
+
+	ctx := newContext()
+	defer ctx.cancel()
+	var results []string
+	for i := 0; i < cycles; i++ {
+		ctx.startRound(time.Time{})
+		gc.collectMetrics(ctx)
+		results = append(results, formatMetrics(ctx.store.gpu.Load().metrics))
+	}
+	return results
+}
+
+// newTestCollector starts a collector of the simulated GPUs of testdata, once IXML
+// is initialized. The metrics config, the scenario and the collect timeout of the
+// options default to testdata/metrics.yaml, testdata/scenario.yaml and 1s.
+func newTestCollector(t *testing.T, opts *Options) *iluvatarCollector {
+	t.Helper()
+	if opts.MetricsConfig == "" {
+		opts.MetricsConfig = filepath.Join("testdata", "metrics.yaml")
+	}
+	if opts.SimulateConfig == "" {
+		opts.SimulateConfig = filepath.Join("testdata", "scenario.yaml")
+	}
+	if opts.CollectTimeout == 0 {
+		opts.CollectTimeout = time.Second
+	}
+
+	ic, err := NewIluvatarCollector(opts)
+	if err != nil {
+		t.Fatalf("NewIluvatarCollector: %v", err)
+	}
+	ic.Start()
+	t.Cleanup(ic.Shutdown)
+
+	for deadline := time.Now().Add(5 * time.Second); !ic.inventory.get().initialized; {
+		if time.Now().After(deadline) {
+			t.Fatal("IXML not initialized")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return ic
+}
+
+// scrapeHandler serves the metrics of the collector like the metrics server, the
+// collector is registered for every scrape.
+func scrapeHandler(ic *iluvatarCollector) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		reg := prometheus.NewRegistry()
+		reg.MustRegister(ic.WithContext(r.Context()))
+		promhttp.HandlerFor(reg, promhttp.HandlerOpts{ErrorHandling: promhttp.ContinueOnError}).ServeHTTP(w, r)
+	})
+}
+
+// scrapeDevices scrapes the collector and returns the metrics in the text format,
+// but the exporter ones whose values depend on the timing.
+func scrapeDevices(t *testing.T, ic *iluvatarCollector) string {
+	t.Helper()
+	naming, err := newMetricNaming(ic.opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := httptest.NewRecorder()
+	scrapeHandler(ic).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("scrape: status %d\n%s", rec.Code, rec.Body)
+	}
+
+	var b strings.Builder
+	exporter := naming.name("ix_exporter_")
+	for _, line := range strings.SplitAfter(rec.Body.String(), "\n") {
+		name := strings.TrimPrefix(strings.TrimPrefix(line, "# HELP "), "# TYPE ")
+		if !strings.HasPrefix(name, exporter) {
+			b.WriteString(line)
+		}
+	}
+	return b.String()
+}
+
+// formatMetrics returns a line per series, sorted by name and labels.
+func formatMetrics(metrics map[string][]metric) string {
+	var lines []string
+	for _, ms := range metrics {
+		for _, m := range ms {
+			labels := make([]string, 0, len(m.labels))
+			for key, value := range m.labels {
+				labels = append(labels, fmt.Sprintf("%s=%q", key, value))
+			}
+			sort.Strings(labels)
+			lines = append(lines, fmt.Sprintf("%s{%s} %v", m.name, strings.Join(labels, ","), m.value))
+		}
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n") + "\n"
+}
+
+// checkGolden compares the metrics with the golden file of testdata/golden, which
+// is written instead with -update.
+func checkGolden(t *testing.T, name, got string) {
+	t.Helper()
+	path := filepath.Join("testdata", "golden", name)
+	if *update {
+		if err := os.WriteFile(path, []byte(got), 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got != string(want) {
+		t.Errorf("metrics differ from %s, got:\n%s", path, got)
+	}
+}
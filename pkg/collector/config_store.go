@@ -0,0 +1,164 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"sync/atomic"
+
+	"gitee.com/deep-spark/ixexporter/pkg/config"
+	"gitee.com/deep-spark/ixexporter/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// activeConfig is the metrics config and the cluster config in use, it is not
+// modified once stored, a reload stores a new one.
+type activeConfig struct {
+	collectorConfigs []collectorConfig
+	resources        map[string][]*metricDesc
+	gpmMetricIds     []uint32
+	expected         config.ExpectedVersions
+	splitBoard       bool
+}
+
+// configStore holds the active config shared by iluvatarCollector and the
+// subcollectors, which read it without lock while a reload swaps it.
+type configStore struct {
+	active atomic.Pointer[activeConfig]
+}
+
+func newConfigStore(active *activeConfig) *configStore {
+	store := &configStore{}
+	store.active.Store(active)
+	return store
+}
+
+func (s *configStore) get() *activeConfig {
+	return s.active.Load()
+}
+
+func (s *configStore) set(active *activeConfig) {
+	s.active.Store(active)
+}
+
+// loadConfig loads the metrics config of the options, and the cluster config in
+// kubernetes mode. The descriptors of the gpu metrics carry the labels. An invalid
+// cluster config disables split board at start, but fails a reload so that the
+// previous one is kept.
+func loadConfig(opts *Options, labels []string, reload bool) (*activeConfig, error) {
+	active, err := loadMetricsConfig(opts, labels)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.EnableKube {
+		if active.splitBoard, err = loadClusterConfig(opts.ClusterConfig); err != nil {
+			if reload {
+				return nil, err
+			}
+			logger.IluvatarLog.Errorf("Failed to get split board, split board disabled: %v", err)
+		}
+	}
+	return active, nil
+}
+
+func loadMetricsConfig(opts *Options, labels []string) (*activeConfig, error) {
+	iluvatarConfig, err := loadExporterConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	naming, err := newMetricNaming(opts)
+	if err != nil {
+		return nil, err
+	}
+
+	collectorConfigs := getMetricConfig(iluvatarConfig)
+	var gpmMetricIds []uint32
+	for _, mc := range collectorConfigs {
+		if metricId, ok := gpmMetrics[mc.Name]; ok {
+			gpmMetricIds = append(gpmMetricIds, metricId)
+		}
+	}
+
+	return &activeConfig{
+		collectorConfigs: collectorConfigs,
+		resources:        buildResources(collectorConfigs, labels, naming),
+		gpmMetricIds:     gpmMetricIds,
+		expected:         iluvatarConfig.ExpectedVersions,
+	}, nil
+}
+
+// buildResources builds the descriptors of the gpu metrics of the metrics config,
+// a metric has two in the compat naming. A metric renamed or scaled by the metrics
+// config is exported as configured in every naming.
+func buildResources(collectorConfigs []collectorConfig, labels []string, naming *metricNaming) map[string][]*metricDesc {
+	resources := make(map[string][]*metricDesc)
+	for _, mc := range collectorConfigs {
+		var labelsForDesc []string
+		labelsForDesc = append(labelsForDesc, labels...)
+		labelsForDesc = append(labelsForDesc, MetricExtraLabels[mc.Name]...)
+		constLabels := naming.labels(mc.ConstLabels)
+
+		valueType := prometheus.GaugeValue
+		if mc.Type == config.MetricTypeCounter || (mc.Type == "" && CounterMetrics[mc.Name]) {
+			valueType = prometheus.CounterValue
+		}
+
+		conventional, ok := conventionalMetrics[mc.Name]
+		ok = ok && mc.ExportName == mc.Name && mc.Scale == 1
+		if !ok || naming.legacy() {
+			resources[mc.Name] = append(resources[mc.Name], &metricDesc{
+				desc:      prometheus.NewDesc(naming.name(mc.ExportName), mc.Help, labelsForDesc, constLabels),
+				valueType: valueType,
+				scale:     mc.Scale,
+			})
+			logger.IluvatarLog.Infof("Register gpu resource '%s' as '%s'", mc.Name, naming.name(mc.ExportName))
+		}
+		if ok && naming.conventional() {
+			if conventional.counter && mc.Type == "" {
+				valueType = prometheus.CounterValue
+			}
+			resources[mc.Name] = append(resources[mc.Name], &metricDesc{
+				desc: prometheus.NewDesc(naming.name(conventional.name), conventionalHelp(mc.Help),
+					labelsForDesc, constLabels),
+				valueType: valueType,
+				scale:     conventional.scale,
+			})
+			logger.IluvatarLog.Infof("Register gpu resource '%s' as '%s'", mc.Name, naming.name(conventional.name))
+		}
+	}
+	return resources
+}
+
+// configCheck describes the metrics of a config without collecting any, so that
+// registering it to check the config does not change what a registry gathers.
+type configCheck struct {
+	metrics   *exporterMetrics
+	resources map[string][]*metricDesc
+}
+
+func (cc *configCheck) Describe(ch chan<- *prometheus.Desc) {
+	cc.metrics.describe(ch)
+	for _, descs := range cc.resources {
+		for _, resource := range descs {
+			ch <- resource.desc
+		}
+	}
+}
+
+func (cc *configCheck) Collect(ch chan<- prometheus.Metric) {}
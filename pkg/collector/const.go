@@ -20,6 +20,10 @@ package collector
 const (
 	Iluvatar = "iluvatar"
 
+	// DefaultNamespace is the prefix of the metric names, it is replaced by the
+	// metric namespace of the options.
+	DefaultNamespace = "ix"
+
 	Temperature     = "ix_temperature"
 	FanSpeed        = "ix_fan_speed"
 	SmClock         = "ix_sm_clock"
@@ -35,6 +39,56 @@ const (
 	EccSbeVolStatus = "ix_ecc_sbe_vol_status"
 	EccDbeVolStatus = "ix_ecc_dbe_vol_status"
 	SmUtilization   = "ix_sm_utilization"
+
+	GpmGraphicsUtilization   = "ix_gpm_graphics_utilization"
+	GpmSmOccupancy           = "ix_gpm_sm_occupancy"
+	GpmIntegerUtilization    = "ix_gpm_integer_utilization"
+	GpmTensorUtilization     = "ix_gpm_tensor_utilization"
+	GpmDfmaTensorUtilization = "ix_gpm_dfma_tensor_utilization"
+	GpmHmmaTensorUtilization = "ix_gpm_hmma_tensor_utilization"
+	GpmImmaTensorUtilization = "ix_gpm_imma_tensor_utilization"
+	GpmDramBwUtilization     = "ix_gpm_dram_bandwidth_utilization"
+	GpmFp64Utilization       = "ix_gpm_fp64_utilization"
+	GpmFp32Utilization       = "ix_gpm_fp32_utilization"
+	GpmFp16Utilization       = "ix_gpm_fp16_utilization"
+	GpmPcieTxBandwidth       = "ix_gpm_pcie_tx_bandwidth"
+	GpmPcieRxBandwidth       = "ix_gpm_pcie_rx_bandwidth"
+	GpmLinkTxBandwidth       = "ix_gpm_link_tx_bandwidth"
+	GpmLinkRxBandwidth       = "ix_gpm_link_rx_bandwidth"
+
+	PcieTxThroughput = "ix_pcie_tx_throughput"
+	PcieRxThroughput = "ix_pcie_rx_throughput"
+	PcieReplayCount  = "ix_pcie_replay_counter"
+	PcieLinkGen      = "ix_pcie_link_gen_current"
+	PcieLinkGenMax   = "ix_pcie_link_gen_max"
+	PcieLinkWidth    = "ix_pcie_link_width_current"
+	PcieLinkWidthMax = "ix_pcie_link_width_max"
+
+	ClockThrottleReason   = "ix_clock_throttle_reason"
+	ClockThrottleDuration = "ix_clock_throttle_duration_seconds_total"
+
+	GpuPresent            = "ix_gpu_present"
+	EnumerationChanges    = "ix_gpu_enumeration_changes_total"
+	IxmlUp                = "ix_exporter_ixml_up"
+	IxmlInitFailures      = "ix_exporter_ixml_init_failures_total"
+	DriverInfo            = "ix_driver_info"
+	DriverMismatch        = "ix_driver_version_mismatch"
+	DeviceInfo            = "ix_device_info"
+	XidErrorsTotal        = "ix_xid_errors_total"
+	XidLastTimestamp      = "ix_xid_last_timestamp_seconds"
+	DeviceCollectTimeouts = "ix_device_collect_timeout_total"
+	DeviceQueryDuration   = "ix_exporter_device_query_duration_seconds"
+	DeviceQueryErrors     = "ix_device_query_errors_total"
+	MetricSupported       = "ix_metric_supported"
+	SnapshotGeneration    = "ix_exporter_snapshot_generation"
+	SnapshotTimestamp     = "ix_exporter_snapshot_timestamp_seconds"
+	CollectDuration       = "ix_exporter_collect_duration_seconds"
+	LastSuccessfulCollect = "ix_exporter_last_successful_collect_timestamp_seconds"
+	CollectTimeouts       = "ix_exporter_collect_timeouts_total"
+	BuildInfo             = "ix_exporter_build_info"
+	ScrapesCoalesced      = "ix_exporter_scrapes_coalesced_total"
+	ConfigReloadSuccess   = "ix_exporter_config_reload_success"
+	ConfigLastReload      = "ix_exporter_config_last_reload_success_timestamp_seconds"
 )
 
 const (
@@ -47,6 +101,29 @@ const (
 	LabelNodeName    = "node_name"
 	LabelProcessPid  = "process_pid"
 	LabelProcessName = "process_name"
+	LabelReason      = "reason"
+	LabelXid         = "xid"
+	LabelQuery       = "query"
+	LabelMetric      = "metric"
+	LabelCode        = "code"
+	LabelCollector   = "collector"
+
+	LabelDriverVersion = "driver_version"
+	LabelCudaVersion   = "cuda_version"
+	LabelIxmlVersion   = "ixml_version"
+	LabelComponent     = "component"
+	LabelExpected      = "expected"
+	LabelActual        = "actual"
+	LabelVersion       = "version"
+	LabelCommit        = "commit"
+	LabelGoVersion     = "goversion"
+
+	LabelPciBusId        = "pci_bus_id"
+	LabelSerial          = "serial"
+	LabelBoardPartNumber = "board_part_number"
+	LabelVbiosVersion    = "vbios_version"
+	LabelMemoryTotal     = "memory_total"
+	LabelBoardPosition   = "board_position"
 )
 
 var LabelList = []string{
@@ -55,6 +132,42 @@ var LabelList = []string{
 	LabelUuid,
 }
 
+// Values of LabelCollector, CollectorScrape is the collection of a scrape by
+// iluvatarCollector rather than a subcollector.
+const (
+	CollectorGpu        = "gpu"
+	CollectorKubernetes = "kubernetes"
+	CollectorScrape     = "scrape"
+)
+
+// Values of a metric whose read failed, see Options.ReadErrorValue.
+const (
+	ReadErrorDrop = "drop"
+	ReadErrorNaN  = "nan"
+)
+
+// Values of Options.MetricNaming, NamingCompat exports the gpu metrics with both
+// their legacy and conventional names.
+const (
+	NamingLegacy       = "legacy"
+	NamingConventional = "conventional"
+	NamingCompat       = "compat"
+)
+
+// MetricExtraLabels are the labels a gpu metric carries after the common ones.
+var MetricExtraLabels = map[string][]string{
+	ProcessInfo:           {LabelProcessPid, LabelProcessName},
+	ClockThrottleReason:   {LabelReason},
+	ClockThrottleDuration: {LabelReason},
+}
+
+// CounterMetrics are the gpu metrics exported as counters rather than gauges, unless
+// the metrics config sets another type.
+var CounterMetrics = map[string]bool{
+	PcieReplayCount:       true,
+	ClockThrottleDuration: true,
+}
+
 var LabelAllList = []string{
 	LabelGPU,
 	LabelName,
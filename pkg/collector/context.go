@@ -20,28 +20,60 @@ package collector
 import (
 	"context"
 	"sync"
+	"time"
 
 	"gitee.com/deep-spark/ixexporter/pkg/logger"
 )
 
+// maxCollectMargin bounds the margin kept before the deadline of a scrape, a tenth
+// of the time left otherwise. It is the only time taken out of the scrape timeout.
+const maxCollectMargin = time.Second
+
 type ixContext struct {
-	ctx         context.Context
-	labels      []string
-	cancelFunc  context.CancelFunc
-	signalCh    chan struct{}
-	collectors  []subCollector
-	metrics     map[string][]metric
-	labelValues map[string]labelType
-	mutex       sync.Mutex
+	ctx        context.Context
+	labels     []string
+	cancelFunc context.CancelFunc
+	signalCh   chan struct{}
+	collectors []subCollector
+	store      *snapshotStore
+	polling    bool
+	mutex      sync.Mutex
+	wg         sync.WaitGroup
+
+	// round is the last collection round started, lastScrape is the start of the
+	// last one started by a scrape.
+	round       *collectRound
+	lastScrape  time.Time
+	minInterval time.Duration
+}
+
+// collectRound is a collection of the subcollectors started by a scrape or by
+// polling, the scrapes which arrive while it is in flight wait for it rather than
+// start another one.
+type collectRound struct {
+	id uint64
+	// deadline is the deadline of the scrape which started the round, zero if
+	// it was started by polling.
+	deadline time.Time
+	// done is closed once the gpu metrics of the round are stored.
+	done     chan struct{}
+	finished bool
 }
 
+// closedSignal is returned by signal for a round the collector has not served yet.
+var closedSignal = func() chan struct{} {
+	ch := make(chan struct{})
+	close(ch)
+	return ch
+}()
+
 func newContext() *ixContext {
 	ctx, cancel := context.WithCancel(context.Background())
 
 	return &ixContext{
 		ctx:        ctx,
 		cancelFunc: cancel,
-		metrics:    make(map[string][]metric),
+		store:      newSnapshotStore(),
 	}
 }
 
@@ -53,42 +85,184 @@ func (ctx *ixContext) done() <-chan struct{} {
 	return ctx.ctx.Done()
 }
 
-func (ctx *ixContext) signal() <-chan struct{} {
+// signal returns a channel closed once a round after the served one is started,
+// served is the id of the last round the collector collected. A round started
+// while the collector is busy, e.g. enumerating the devices, is not missed.
+func (ctx *ixContext) signal(served uint64) <-chan struct{} {
 	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	if ctx.round != nil && ctx.round.id > served {
+		return closedSignal
+	}
 	if ctx.signalCh == nil {
 		ctx.signalCh = make(chan struct{})
 	}
-	ctx.mutex.Unlock()
-
 	return ctx.signalCh
 }
 
+// registerCollector starts the collector in its own goroutine.
 func (ctx *ixContext) registerCollector(collector subCollector) {
 	ctx.collectors = append(ctx.collectors, collector)
+
+	ctx.wg.Add(1)
+	go func() {
+		defer ctx.wg.Done()
+		collector.collect(ctx)
+	}()
+}
+
+// wait waits for the collectors to return after cancel, it reports false if they
+// did not within the timeout.
+func (ctx *ixContext) wait(timeout time.Duration) bool {
+	stopped := make(chan struct{})
+	go func() {
+		ctx.wg.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
 }
 
-func (ctx *ixContext) getMetrics() map[string][]metric {
-	// Notify all collectors to update metrics.
+// startPolling starts a round at every interval rather than at every scrape, so
+// that the number of scrapers does not change the IXML load.
+func (ctx *ixContext) startPolling(interval time.Duration) {
+	ctx.mutex.Lock()
+	ctx.polling = true
+	ctx.mutex.Unlock()
+
+	ctx.wg.Add(1)
+	go func() {
+		defer ctx.wg.Done()
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.done():
+				return
+			case <-ticker.C:
+				ctx.startRound(time.Time{})
+			}
+		}
+	}()
+}
+
+// startRound starts a round whose collections are cancelled at the deadline unless
+// it is zero, it reports false if a round is in flight.
+func (ctx *ixContext) startRound(deadline time.Time) bool {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	if ctx.inFlightLocked() {
+		return false
+	}
+	ctx.startRoundLocked(deadline)
+	return true
+}
+
+func (ctx *ixContext) inFlightLocked() bool {
+	return ctx.round != nil && !ctx.round.finished
+}
+
+// startRoundLocked is startRound with the mutex held, the collectors waiting on
+// signal are woken up.
+func (ctx *ixContext) startRoundLocked(deadline time.Time) *collectRound {
+	var id uint64 = 1
+	if ctx.round != nil {
+		id = ctx.round.id + 1
+	}
+	ctx.round = &collectRound{id: id, deadline: deadline, done: make(chan struct{})}
 	if ctx.signalCh != nil {
 		close(ctx.signalCh)
 		ctx.signalCh = nil
 	}
+	return ctx.round
+}
 
-	for uuid, ms := range ctx.metrics {
-		updateMetrics := []metric{}
+// currentRound returns the last round started, which a collector woken up by
+// signal collects.
+func (ctx *ixContext) currentRound() *collectRound {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
 
-		for _, metric := range ms {
-			if labels, ok := ctx.labelValues[uuid]; ok {
-				for key, value := range labels {
-					metric.labels[key] = value
-				}
-			}
-			updateMetrics = append(updateMetrics, metric)
-		}
-		ctx.metrics[uuid] = updateMetrics
+	return ctx.round
+}
+
+// finishRound releases the scrapes waiting for the round, once its gpu metrics
+// are stored.
+func (ctx *ixContext) finishRound(round *collectRound) {
+	ctx.mutex.Lock()
+	defer ctx.mutex.Unlock()
+
+	if !round.finished {
+		round.finished = true
+		close(round.done)
 	}
+}
 
-	return ctx.metrics
+// collectContext returns the context of a collection of the round, it is cancelled
+// at the deadline of the round or when the collectors stop.
+func (ctx *ixContext) collectContext(round *collectRound) (context.Context, context.CancelFunc) {
+	if round.deadline.IsZero() {
+		return context.WithCancel(ctx.ctx)
+	}
+	return context.WithDeadline(ctx.ctx, round.deadline)
+}
+
+// getMetrics returns the gpu metrics merged with the kubernetes labels. Unless
+// polling, a scrape starts a round and waits for its metrics. A scrape which
+// arrives while a round is in flight waits for that round instead, and a scrape
+// within the minimum interval of the last round started by a scrape gets its
+// metrics at once, it reports true in both cases.
+//
+// The round started by a scrape is cancelled a margin before the deadline of the
+// scrape, so that the GPUs collected before are stored and sent as a partial
+// result within the margin. A scrape which joined a round stops waiting for it at
+// the same margin before its own deadline.
+func (ctx *ixContext) getMetrics(scrape context.Context) (*metricsSnapshot, bool) {
+	ctx.mutex.Lock()
+	if ctx.polling {
+		ctx.mutex.Unlock()
+		return ctx.store.merged(), false
+	}
+
+	deadline, ok := scrape.Deadline()
+	if ok {
+		deadline = deadline.Add(-min(time.Until(deadline)/10, maxCollectMargin))
+	}
+
+	round := ctx.round
+	coalesced := true
+	switch {
+	case ctx.inFlightLocked():
+	case time.Since(ctx.lastScrape) < ctx.minInterval:
+		ctx.mutex.Unlock()
+		return ctx.store.merged(), true
+	default:
+		round = ctx.startRoundLocked(deadline)
+		ctx.lastScrape = time.Now()
+		coalesced = false
+	}
+	ctx.mutex.Unlock()
+
+	wait := scrape
+	if coalesced && ok {
+		var cancel context.CancelFunc
+		wait, cancel = context.WithDeadline(scrape, deadline)
+		defer cancel()
+	}
+
+	select {
+	case <-round.done:
+	case <-wait.Done():
+	}
+	return ctx.store.merged(), coalesced
 }
 
 func (ctx *ixContext) updateMetrics(metrics interface{}) {
@@ -111,8 +285,9 @@ func (ctx *ixContext) updateMetrics(metrics interface{}) {
 			}
 			updateMetrics[uuid] = ms_
 		}
-		ctx.metrics = updateMetrics
+
+		ctx.store.storeGpuMetrics(updateMetrics)
 	case map[string]labelType:
-		ctx.labelValues = metrics
+		ctx.store.storeKubeLabels(metrics)
 	}
 }
@@ -0,0 +1,280 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fakeCollector serves the rounds of the context like the gpu collector, each
+// collection takes the delay unless cancelled and stores the id of its round.
+type fakeCollector struct {
+	delay     time.Duration
+	served    uint64
+	rounds    atomic.Int64
+	cancelled atomic.Int64
+}
+
+func (fc *fakeCollector) collect(ctx *ixContext) {
+	for {
+		select {
+		case <-ctx.done():
+			return
+		case <-ctx.signal(fc.served):
+			round := ctx.currentRound()
+			fc.served = round.id
+			fc.rounds.Add(1)
+
+			collectCtx, cancel := ctx.collectContext(round)
+			select {
+			case <-time.After(fc.delay):
+			case <-collectCtx.Done():
+				fc.cancelled.Add(1)
+			}
+			cancel()
+
+			ctx.updateMetrics(map[string][]metric{
+				"GPU-0": {{name: Temperature, value: float64(round.id), labels: map[string]string{}}},
+			})
+			ctx.finishRound(round)
+		}
+	}
+}
+
+func newTestContext(t *testing.T, collector *fakeCollector, minInterval time.Duration) *ixContext {
+	ctx := newContext()
+	ctx.minInterval = minInterval
+	ctx.registerCollector(collector)
+	t.Cleanup(func() {
+		ctx.cancel()
+		ctx.wait(time.Second)
+	})
+	return ctx
+}
+
+func TestContextScrapeWaitsForItsCollection(t *testing.T) {
+	collector := &fakeCollector{delay: 20 * time.Millisecond}
+	ctx := newTestContext(t, collector, 0)
+
+	for i := uint64(1); i <= 3; i++ {
+		snapshot, coalesced := ctx.getMetrics(context.Background())
+		if coalesced {
+			t.Errorf("scrape %d coalesced", i)
+		}
+		if snapshot.generation != i || snapshot.metrics["GPU-0"][0].value != float64(i) {
+			t.Errorf("scrape %d: got generation %d of round %v", i, snapshot.generation,
+				snapshot.metrics["GPU-0"][0].value)
+		}
+	}
+}
+
+func TestContextCoalescing(t *testing.T) {
+	const scrapes = 8
+	collector := &fakeCollector{delay: 100 * time.Millisecond}
+	ctx := newTestContext(t, collector, 0)
+
+	var wg sync.WaitGroup
+	var coalesced atomic.Int64
+	for i := 0; i < scrapes; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			snapshot, ok := ctx.getMetrics(context.Background())
+			if ok {
+				coalesced.Add(1)
+			}
+			if snapshot.generation != 1 {
+				t.Errorf("got generation %d, want the round in flight", snapshot.generation)
+			}
+		}()
+		// The first scrape starts the round, the others join it.
+		if i == 0 {
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	wg.Wait()
+
+	if rounds := collector.rounds.Load(); rounds != 1 {
+		t.Errorf("got %d rounds, want 1", rounds)
+	}
+	if coalesced.Load() != scrapes-1 {
+		t.Errorf("got %d scrapes coalesced, want %d", coalesced.Load(), scrapes-1)
+	}
+}
+
+func TestContextMinInterval(t *testing.T) {
+	collector := &fakeCollector{}
+	ctx := newTestContext(t, collector, time.Hour)
+
+	if _, coalesced := ctx.getMetrics(context.Background()); coalesced {
+		t.Error("first scrape coalesced")
+	}
+	snapshot, coalesced := ctx.getMetrics(context.Background())
+	if !coalesced || snapshot.generation != 1 {
+		t.Errorf("scrape within the minimum interval: got coalesced %v and generation %d", coalesced,
+			snapshot.generation)
+	}
+	if rounds := collector.rounds.Load(); rounds != 1 {
+		t.Errorf("got %d rounds, want 1", rounds)
+	}
+}
+
+// TestContextSignalNotMissed starts a round before the collector waits for it,
+// like a scrape during an enumeration.
+func TestContextSignalNotMissed(t *testing.T) {
+	ctx := newContext()
+	if !ctx.startRound(time.Time{}) {
+		t.Fatal("round not started")
+	}
+	if ctx.startRound(time.Time{}) {
+		t.Error("round started while one is in flight")
+	}
+
+	select {
+	case <-ctx.signal(0):
+	default:
+		t.Fatal("round started before the wait missed")
+	}
+	round := ctx.currentRound()
+	select {
+	case <-ctx.signal(round.id):
+		t.Fatal("round served twice")
+	default:
+	}
+
+	ctx.finishRound(round)
+	if !ctx.startRound(time.Time{}) {
+		t.Error("round not started once the previous one finished")
+	}
+}
+
+// TestContextScrapeDeadline checks that a collection longer than the scrape timeout
+// is cancelled before it, so that the scrape gets its partial result in time.
+func TestContextScrapeDeadline(t *testing.T) {
+	collector := &fakeCollector{delay: time.Hour}
+	ctx := newTestContext(t, collector, 0)
+
+	const timeout = 200 * time.Millisecond
+	scrape, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	start := time.Now()
+	snapshot, _ := ctx.getMetrics(scrape)
+	if scrape.Err() != nil {
+		t.Fatalf("scrape returned after its timeout, in %v", time.Since(start))
+	}
+	if snapshot.generation != 1 || collector.cancelled.Load() != 1 {
+		t.Errorf("got generation %d and %d collections cancelled, want the cancelled one",
+			snapshot.generation, collector.cancelled.Load())
+	}
+}
+
+// TestContextJoinedScrapeDeadline checks that a scrape which joined a round started
+// by a scrape with a later deadline stops waiting for it before its own deadline.
+func TestContextJoinedScrapeDeadline(t *testing.T) {
+	collector := &fakeCollector{delay: time.Hour}
+	ctx := newTestContext(t, collector, 0)
+
+	first, cancelFirst := context.WithTimeout(context.Background(), time.Hour)
+	defer cancelFirst()
+	go ctx.getMetrics(first)
+	for ctx.currentRound() == nil {
+		time.Sleep(time.Millisecond)
+	}
+
+	scrape, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, coalesced := ctx.getMetrics(scrape); !coalesced {
+		t.Error("scrape did not join the round in flight")
+	}
+	if scrape.Err() != nil {
+		t.Errorf("joined scrape returned after its timeout, in %v", time.Since(start))
+	}
+}
+
+func TestContextPolling(t *testing.T) {
+	collector := &fakeCollector{}
+	ctx := newTestContext(t, collector, 0)
+	ctx.startPolling(10 * time.Millisecond)
+
+	for deadline := time.Now().Add(5 * time.Second); collector.rounds.Load() < 3; {
+		if time.Now().After(deadline) {
+			t.Fatal("polling started no round")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if _, coalesced := ctx.getMetrics(context.Background()); coalesced {
+		t.Error("scrape coalesced while polling")
+	}
+}
+
+// TestParallelScrapes runs concurrent /metrics scrapes of the simulated GPUs, it is
+// meant to run with -race. Every scrape either starts a collection or is counted
+// as coalesced.
+func TestParallelScrapes(t *testing.T) {
+	const scrapers, scrapes = 8, 5
+	ic := newTestCollector(t, &Options{})
+	server := httptest.NewServer(scrapeHandler(ic))
+	defer server.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < scrapers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < scrapes; j++ {
+				resp, err := http.Get(server.URL)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				body, err := io.ReadAll(resp.Body)
+				resp.Body.Close()
+				if err != nil || resp.StatusCode != http.StatusOK {
+					t.Errorf("scrape failed: %d %v", resp.StatusCode, err)
+					return
+				}
+				if !strings.Contains(string(body), "\nix_temperature{") {
+					t.Errorf("scrape without gpu metrics:\n%s", body)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	var coalesced dto.Metric
+	if err := ic.metrics.scrapesCoalesced.Write(&coalesced); err != nil {
+		t.Fatal(err)
+	}
+	generation := ic.ctx.store.merged().generation
+	if total := generation + uint64(coalesced.GetCounter().GetValue()); total != scrapers*scrapes {
+		t.Errorf("got %d collections and %v scrapes coalesced, want %d scrapes", generation,
+			coalesced.GetCounter().GetValue(), scrapers*scrapes)
+	}
+}
@@ -0,0 +1,457 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"time"
+
+	"gitee.com/deep-spark/go-ixml/pkg/ixml"
+)
+
+// deviceBackend is the system level access to the GPUs. The collectors never call
+// IXML directly, so that the exporter can run against a simulated backend too.
+type deviceBackend interface {
+	Init() ixml.Return
+	Shutdown() ixml.Return
+	DeviceGetCount() (uint, ixml.Return)
+	SystemGetDriverVersion() (string, ixml.Return)
+	SystemGetCudaDriverVersion() (string, ixml.Return)
+	SystemGetIXMLVersion() (string, ixml.Return)
+	DeviceGetHandleByIndex(index uint) (gpuDevice, ixml.Return)
+	GetHandleByUUID(uuid string) (gpuDevice, ixml.Return)
+	GetOnSameBoard(first, second gpuDevice) (int, ixml.Return)
+	EventSetCreate() (eventSet, ixml.Return)
+}
+
+// gpuDevice is the per-device access used by getDeviceInfo and the metric collectors.
+type gpuDevice interface {
+	GetName() (string, ixml.Return)
+	GetUUID() (string, ixml.Return)
+	GetBoardPosition() (uint32, ixml.Return)
+	GetPciBusId() (string, ixml.Return)
+	GetSerial() (string, ixml.Return)
+	GetBoardPartNumber() (string, ixml.Return)
+	GetVbiosVersion() (string, ixml.Return)
+	GetTemperature() (uint32, ixml.Return)
+	GetFanSpeed() (uint32, ixml.Return)
+	GetClockInfo() (clockInfo, ixml.Return)
+	GetMemoryInfo() (memoryInfo, ixml.Return)
+	GetPowerUsage() (uint32, ixml.Return)
+	GetUtilizationRates() (utilizationInfo, ixml.Return)
+	GetComputeRunningProcesses() ([]processInfo, ixml.Return)
+	GetCurrentClocksThrottleReasons() (uint64, ixml.Return)
+	GetViolationTime(policy violationPolicy) (uint64, ixml.Return)
+	GetPcieThroughput() (pcieThroughput, ixml.Return)
+	GetPcieReplayCounter() (uint32, ixml.Return)
+	GetPcieLinkInfo() (pcieLinkInfo, ixml.Return)
+	GetEccErros() (uint64, uint64, ixml.Return)
+	GpmQueryDeviceSupport() (bool, ixml.Return)
+	GpmSampleGet() (gpmSample, ixml.Return)
+	GpmMetricGet(sample1, sample2 gpmSample, metricId uint32) (float64, ixml.Return)
+}
+
+// cycleDevice is a device whose answers follow the collection cycles rather than
+// the calls, e.g. a simulated one. beginCycle is called at the start of each cycle.
+type cycleDevice interface {
+	beginCycle()
+}
+
+// eventSet delivers the critical XID events of the devices registered to it.
+// Wait returns ERROR_TIMEOUT if no event occurred within the timeout.
+type eventSet interface {
+	Register(device gpuDevice) ixml.Return
+	Wait(timeout time.Duration) (xidEvent, ixml.Return)
+	Free()
+}
+
+type xidEvent struct {
+	uuid      string
+	xid       uint64
+	timestamp time.Time
+}
+
+// gpmSample is an opaque GPM sample taken by gpuDevice.GpmSampleGet.
+type gpmSample interface {
+	Free()
+}
+
+type clockInfo struct {
+	sm  uint32
+	mem uint32
+}
+
+type memoryInfo struct {
+	total uint64
+	used  uint64
+	free  uint64
+}
+
+type utilizationInfo struct {
+	gpu    uint32
+	memory uint32
+}
+
+type processInfo struct {
+	pid           uint32
+	usedGpuMemory uint64
+}
+
+// violationPolicy is a reason for which the clocks are held down, its value is
+// the 'reason' label of ix_clock_throttle_duration_seconds_total.
+type violationPolicy string
+
+const (
+	violationPower          violationPolicy = "power"
+	violationThermal        violationPolicy = "thermal"
+	violationSyncBoost      violationPolicy = "sync_boost"
+	violationBoardLimit     violationPolicy = "board_limit"
+	violationLowUtilization violationPolicy = "low_utilization"
+	violationReliability    violationPolicy = "reliability"
+	violationAppClocks      violationPolicy = "applications_clocks"
+	violationBaseClocks     violationPolicy = "base_clocks"
+)
+
+var violationPolicies = []violationPolicy{
+	violationPower,
+	violationThermal,
+	violationSyncBoost,
+	violationBoardLimit,
+	violationLowUtilization,
+	violationReliability,
+	violationAppClocks,
+	violationBaseClocks,
+}
+
+// pcieThroughput is in KB/s.
+type pcieThroughput struct {
+	tx uint32
+	rx uint32
+}
+
+type pcieLinkInfo struct {
+	currGeneration uint32
+	maxGeneration  uint32
+	currWidth      uint32
+	maxWidth       uint32
+}
+
+func newDeviceBackend(opts *Options) (deviceBackend, error) {
+	if opts.ReplayFile != "" {
+		return newReplayBackend(opts.ReplayFile)
+	}
+	if opts.SimulateConfig != "" {
+		return newSimulatedBackend(opts.SimulateConfig)
+	}
+	return ixmlBackend{}, nil
+}
+
+// ixmlBackend forwards every call to the IXML library.
+type ixmlBackend struct{}
+
+func (ixmlBackend) Init() ixml.Return {
+	return ixml.Init()
+}
+
+func (ixmlBackend) Shutdown() ixml.Return {
+	return ixml.Shutdown()
+}
+
+func (ixmlBackend) DeviceGetCount() (uint, ixml.Return) {
+	count, ret := ixml.DeviceGetCount()
+	return uint(count), ret
+}
+
+func (ixmlBackend) SystemGetDriverVersion() (string, ixml.Return) {
+	return ixml.SystemGetDriverVersion()
+}
+
+func (ixmlBackend) SystemGetCudaDriverVersion() (string, ixml.Return) {
+	return ixml.SystemGetCudaDriverVersion()
+}
+
+func (ixmlBackend) SystemGetIXMLVersion() (string, ixml.Return) {
+	return ixml.SystemGetIXMLVersion()
+}
+
+func (ixmlBackend) DeviceGetHandleByIndex(index uint) (gpuDevice, ixml.Return) {
+	var device ixml.Device
+
+	ret := ixml.DeviceGetHandleByIndex(index, &device)
+	return ixmlDevice{device: device}, ret
+}
+
+func (ixmlBackend) GetHandleByUUID(uuid string) (gpuDevice, ixml.Return) {
+	device, ret := ixml.GetHandleByUUID(uuid)
+	return ixmlDevice{device: device}, ret
+}
+
+func (ixmlBackend) GetOnSameBoard(first, second gpuDevice) (int, ixml.Return) {
+	d1, ok1 := first.(ixmlDevice)
+	d2, ok2 := second.(ixmlDevice)
+	if !ok1 || !ok2 {
+		return 0, ixml.ERROR_INVALID_ARGUMENT
+	}
+	onSameBoard, ret := ixml.GetOnSameBoard(d1.device, d2.device)
+	return int(onSameBoard), ret
+}
+
+func (ixmlBackend) EventSetCreate() (eventSet, ixml.Return) {
+	set, ret := ixml.EventSetCreate()
+	if ret != ixml.SUCCESS {
+		return nil, ret
+	}
+	return ixmlEventSet{set: set}, ret
+}
+
+type ixmlEventSet struct {
+	set ixml.EventSet
+}
+
+func (s ixmlEventSet) Register(device gpuDevice) ixml.Return {
+	d, ok := device.(ixmlDevice)
+	if !ok {
+		return ixml.ERROR_INVALID_ARGUMENT
+	}
+
+	supported, ret := d.device.GetSupportedEventTypes()
+	if ret != ixml.SUCCESS {
+		return ret
+	}
+	if supported&ixml.EventTypeXidCriticalError == 0 {
+		return ixml.ERROR_NOT_SUPPORTED
+	}
+	return d.device.RegisterEvents(ixml.EventTypeXidCriticalError, s.set)
+}
+
+func (s ixmlEventSet) Wait(timeout time.Duration) (xidEvent, ixml.Return) {
+	data, ret := s.set.Wait(uint32(timeout.Milliseconds()))
+	if ret != ixml.SUCCESS {
+		return xidEvent{}, ret
+	}
+	if data.EventType != ixml.EventTypeXidCriticalError {
+		return xidEvent{}, ixml.ERROR_TIMEOUT
+	}
+
+	uuid, ret := data.Device.GetUUID()
+	if ret != ixml.SUCCESS {
+		return xidEvent{}, ret
+	}
+	return xidEvent{uuid: uuid, xid: uint64(data.EventData), timestamp: time.Now()}, ixml.SUCCESS
+}
+
+func (s ixmlEventSet) Free() {
+	_ = s.set.Free()
+}
+
+type ixmlDevice struct {
+	device ixml.Device
+}
+
+func (d ixmlDevice) GetName() (string, ixml.Return) {
+	return d.device.GetName()
+}
+
+func (d ixmlDevice) GetUUID() (string, ixml.Return) {
+	return d.device.GetUUID()
+}
+
+func (d ixmlDevice) GetBoardPosition() (uint32, ixml.Return) {
+	pos, ret := d.device.GetBoardPosition()
+	return uint32(pos), ret
+}
+
+func (d ixmlDevice) GetPciBusId() (string, ixml.Return) {
+	pci, ret := d.device.GetPciInfo()
+	return pci.BusId, ret
+}
+
+func (d ixmlDevice) GetSerial() (string, ixml.Return) {
+	return d.device.GetSerial()
+}
+
+func (d ixmlDevice) GetBoardPartNumber() (string, ixml.Return) {
+	return d.device.GetBoardPartNumber()
+}
+
+func (d ixmlDevice) GetVbiosVersion() (string, ixml.Return) {
+	return d.device.GetVbiosVersion()
+}
+
+func (d ixmlDevice) GetTemperature() (uint32, ixml.Return) {
+	temperature, ret := d.device.GetTemperature()
+	return uint32(temperature), ret
+}
+
+func (d ixmlDevice) GetFanSpeed() (uint32, ixml.Return) {
+	speed, ret := d.device.GetFanSpeed()
+	return uint32(speed), ret
+}
+
+func (d ixmlDevice) GetClockInfo() (clockInfo, ixml.Return) {
+	clock, ret := d.device.GetClockInfo()
+	return clockInfo{sm: uint32(clock.Sm), mem: uint32(clock.Mem)}, ret
+}
+
+func (d ixmlDevice) GetMemoryInfo() (memoryInfo, ixml.Return) {
+	mem, ret := d.device.GetMemoryInfo()
+	return memoryInfo{total: uint64(mem.Total), used: uint64(mem.Used), free: uint64(mem.Free)}, ret
+}
+
+func (d ixmlDevice) GetPowerUsage() (uint32, ixml.Return) {
+	usage, ret := d.device.GetPowerUsage()
+	return uint32(usage), ret
+}
+
+func (d ixmlDevice) GetUtilizationRates() (utilizationInfo, ixml.Return) {
+	utilization, ret := d.device.GetUtilizationRates()
+	return utilizationInfo{gpu: uint32(utilization.Gpu), memory: uint32(utilization.Memory)}, ret
+}
+
+func (d ixmlDevice) GetComputeRunningProcesses() ([]processInfo, ixml.Return) {
+	infos, ret := d.device.GetComputeRunningProcesses()
+	processInfos := make([]processInfo, 0, len(infos))
+	for _, info := range infos {
+		processInfos = append(processInfos, processInfo{
+			pid:           uint32(info.Pid),
+			usedGpuMemory: uint64(info.UsedGpuMemory),
+		})
+	}
+	return processInfos, ret
+}
+
+func (d ixmlDevice) GetCurrentClocksThrottleReasons() (uint64, ixml.Return) {
+	reasons, ret := d.device.GetCurrentClocksThrottleReasons()
+	return uint64(reasons), ret
+}
+
+var ixmlPerfPolicies = map[violationPolicy]ixml.PerfPolicyType{
+	violationPower:          ixml.PERF_POLICY_POWER,
+	violationThermal:        ixml.PERF_POLICY_THERMAL,
+	violationSyncBoost:      ixml.PERF_POLICY_SYNC_BOOST,
+	violationBoardLimit:     ixml.PERF_POLICY_BOARD_LIMIT,
+	violationLowUtilization: ixml.PERF_POLICY_LOW_UTILIZATION,
+	violationReliability:    ixml.PERF_POLICY_RELIABILITY,
+	violationAppClocks:      ixml.PERF_POLICY_TOTAL_APP_CLOCKS,
+	violationBaseClocks:     ixml.PERF_POLICY_TOTAL_BASE_CLOCKS,
+}
+
+// GetViolationTime returns the cumulative time in ns the clocks were held down
+// by the given policy.
+func (d ixmlDevice) GetViolationTime(policy violationPolicy) (uint64, ixml.Return) {
+	perfPolicy, ok := ixmlPerfPolicies[policy]
+	if !ok {
+		return 0, ixml.ERROR_INVALID_ARGUMENT
+	}
+	violation, ret := d.device.GetViolationStatus(perfPolicy)
+	return uint64(violation.ViolationTime), ret
+}
+
+func (d ixmlDevice) GetPcieThroughput() (pcieThroughput, ixml.Return) {
+	tx, ret := d.device.GetPcieThroughput(ixml.PCIE_UTIL_TX_BYTES)
+	if ret != ixml.SUCCESS {
+		return pcieThroughput{}, ret
+	}
+	rx, ret := d.device.GetPcieThroughput(ixml.PCIE_UTIL_RX_BYTES)
+	if ret != ixml.SUCCESS {
+		return pcieThroughput{}, ret
+	}
+	return pcieThroughput{tx: uint32(tx), rx: uint32(rx)}, ixml.SUCCESS
+}
+
+func (d ixmlDevice) GetPcieReplayCounter() (uint32, ixml.Return) {
+	count, ret := d.device.GetPcieReplayCounter()
+	return uint32(count), ret
+}
+
+func (d ixmlDevice) GetPcieLinkInfo() (pcieLinkInfo, ixml.Return) {
+	var link pcieLinkInfo
+
+	currGeneration, ret := d.device.GetCurrPcieLinkGeneration()
+	if ret != ixml.SUCCESS {
+		return link, ret
+	}
+	maxGeneration, ret := d.device.GetMaxPcieLinkGeneration()
+	if ret != ixml.SUCCESS {
+		return link, ret
+	}
+	currWidth, ret := d.device.GetCurrPcieLinkWidth()
+	if ret != ixml.SUCCESS {
+		return link, ret
+	}
+	maxWidth, ret := d.device.GetMaxPcieLinkWidth()
+	if ret != ixml.SUCCESS {
+		return link, ret
+	}
+
+	link = pcieLinkInfo{
+		currGeneration: uint32(currGeneration),
+		maxGeneration:  uint32(maxGeneration),
+		currWidth:      uint32(currWidth),
+		maxWidth:       uint32(maxWidth),
+	}
+	return link, ixml.SUCCESS
+}
+
+func (d ixmlDevice) GetEccErros() (uint64, uint64, ixml.Return) {
+	singleErr, doubleErr, ret := d.device.GetEccErros()
+	return uint64(singleErr), uint64(doubleErr), ret
+}
+
+func (d ixmlDevice) GpmQueryDeviceSupport() (bool, ixml.Return) {
+	support, ret := d.device.GpmQueryDeviceSupport()
+	return support.IsSupportedDevice != 0, ret
+}
+
+type ixmlGpmSample struct {
+	sample ixml.GpmSample
+}
+
+func (s ixmlGpmSample) Free() {
+	_ = s.sample.Free()
+}
+
+func (d ixmlDevice) GpmSampleGet() (gpmSample, ixml.Return) {
+	sample, ret := ixml.GpmSampleAlloc()
+	if ret != ixml.SUCCESS {
+		return nil, ret
+	}
+	if ret = d.device.GpmSampleGet(sample); ret != ixml.SUCCESS {
+		_ = sample.Free()
+		return nil, ret
+	}
+	return ixmlGpmSample{sample: sample}, ixml.SUCCESS
+}
+
+func (d ixmlDevice) GpmMetricGet(sample1, sample2 gpmSample, metricId uint32) (float64, ixml.Return) {
+	s1, ok1 := sample1.(ixmlGpmSample)
+	s2, ok2 := sample2.(ixmlGpmSample)
+	if !ok1 || !ok2 {
+		return 0, ixml.ERROR_INVALID_ARGUMENT
+	}
+
+	gpmMetric := ixml.GpmMetricsGetType{
+		NumMetrics: 1,
+		Sample1:    s1.sample,
+		Sample2:    s2.sample,
+	}
+	gpmMetric.Metrics[0].MetricId = metricId
+	if ret := ixml.GpmMetricsGet(&gpmMetric); ret != ixml.SUCCESS {
+		return 0, ret
+	}
+	return float64(gpmMetric.Metrics[0].Value), ixml.SUCCESS
+}
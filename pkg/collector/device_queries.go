@@ -0,0 +1,173 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"time"
+
+	"gitee.com/deep-spark/go-ixml/pkg/ixml"
+)
+
+// deviceQueries runs the device queries of one collection cycle. Each query is
+// made once and its result shared by all the metrics derived from it, e.g. the
+// memory info by ix_mem_total, ix_mem_used and ix_mem_free. The duration of each
+// query is recorded in ix_exporter_device_query_duration_seconds.
+type deviceQueries struct {
+	device  gpuDevice
+	metrics *exporterMetrics
+	results map[string]queryResult
+}
+
+type queryResult struct {
+	value interface{}
+	ret   ixml.Return
+}
+
+type eccErrors struct {
+	sbe uint64
+	dbe uint64
+}
+
+// newDeviceQueries returns the queries of a new collection cycle of the device.
+func newDeviceQueries(device gpuDevice, metrics *exporterMetrics) *deviceQueries {
+	if cd, ok := device.(cycleDevice); ok {
+		cd.beginCycle()
+	}
+	return &deviceQueries{
+		device:  device,
+		metrics: metrics,
+		results: make(map[string]queryResult),
+	}
+}
+
+// run returns the result of the query, which is made on the first call only. The
+// key tells apart the calls of a query with different arguments.
+func (q *deviceQueries) run(query, key string, call func() (interface{}, ixml.Return)) (interface{}, ixml.Return) {
+	if result, ok := q.results[key]; ok {
+		return result.value, result.ret
+	}
+
+	start := time.Now()
+	value, ret := call()
+	q.metrics.queryDuration.WithLabelValues(query).Observe(time.Since(start).Seconds())
+
+	q.results[key] = queryResult{value: value, ret: ret}
+	return value, ret
+}
+
+func (q *deviceQueries) GetTemperature() (uint32, ixml.Return) {
+	value, ret := q.run(queryTemperature, queryTemperature, func() (interface{}, ixml.Return) {
+		return q.device.GetTemperature()
+	})
+	return value.(uint32), ret
+}
+
+func (q *deviceQueries) GetFanSpeed() (uint32, ixml.Return) {
+	value, ret := q.run(queryFanSpeed, queryFanSpeed, func() (interface{}, ixml.Return) {
+		return q.device.GetFanSpeed()
+	})
+	return value.(uint32), ret
+}
+
+func (q *deviceQueries) GetClockInfo() (clockInfo, ixml.Return) {
+	value, ret := q.run(queryClock, queryClock, func() (interface{}, ixml.Return) {
+		return q.device.GetClockInfo()
+	})
+	return value.(clockInfo), ret
+}
+
+func (q *deviceQueries) GetMemoryInfo() (memoryInfo, ixml.Return) {
+	value, ret := q.run(queryMemory, queryMemory, func() (interface{}, ixml.Return) {
+		return q.device.GetMemoryInfo()
+	})
+	return value.(memoryInfo), ret
+}
+
+func (q *deviceQueries) GetPowerUsage() (uint32, ixml.Return) {
+	value, ret := q.run(queryPowerUsage, queryPowerUsage, func() (interface{}, ixml.Return) {
+		return q.device.GetPowerUsage()
+	})
+	return value.(uint32), ret
+}
+
+func (q *deviceQueries) GetUtilizationRates() (utilizationInfo, ixml.Return) {
+	value, ret := q.run(queryUtilization, queryUtilization, func() (interface{}, ixml.Return) {
+		return q.device.GetUtilizationRates()
+	})
+	return value.(utilizationInfo), ret
+}
+
+func (q *deviceQueries) GetComputeRunningProcesses() ([]processInfo, ixml.Return) {
+	value, ret := q.run(queryProcesses, queryProcesses, func() (interface{}, ixml.Return) {
+		return q.device.GetComputeRunningProcesses()
+	})
+	return value.([]processInfo), ret
+}
+
+func (q *deviceQueries) GetCurrentClocksThrottleReasons() (uint64, ixml.Return) {
+	value, ret := q.run(queryThrottleReasons, queryThrottleReasons, func() (interface{}, ixml.Return) {
+		return q.device.GetCurrentClocksThrottleReasons()
+	})
+	return value.(uint64), ret
+}
+
+func (q *deviceQueries) GetViolationTime(policy violationPolicy) (uint64, ixml.Return) {
+	value, ret := q.run(queryViolationTime, queryViolationTime+"/"+string(policy), func() (interface{}, ixml.Return) {
+		return q.device.GetViolationTime(policy)
+	})
+	return value.(uint64), ret
+}
+
+func (q *deviceQueries) GetEccErros() (uint64, uint64, ixml.Return) {
+	value, ret := q.run(queryEcc, queryEcc, func() (interface{}, ixml.Return) {
+		sbe, dbe, ret := q.device.GetEccErros()
+		return eccErrors{sbe: sbe, dbe: dbe}, ret
+	})
+	errors := value.(eccErrors)
+	return errors.sbe, errors.dbe, ret
+}
+
+func (q *deviceQueries) GetPcieThroughput() (pcieThroughput, ixml.Return) {
+	value, ret := q.run(queryPcieThroughput, queryPcieThroughput, func() (interface{}, ixml.Return) {
+		return q.device.GetPcieThroughput()
+	})
+	return value.(pcieThroughput), ret
+}
+
+func (q *deviceQueries) GetPcieReplayCounter() (uint32, ixml.Return) {
+	value, ret := q.run(queryPcieReplay, queryPcieReplay, func() (interface{}, ixml.Return) {
+		return q.device.GetPcieReplayCounter()
+	})
+	return value.(uint32), ret
+}
+
+func (q *deviceQueries) GetPcieLinkInfo() (pcieLinkInfo, ixml.Return) {
+	value, ret := q.run(queryPcieLink, queryPcieLink, func() (interface{}, ixml.Return) {
+		return q.device.GetPcieLinkInfo()
+	})
+	return value.(pcieLinkInfo), ret
+}
+
+// gpmSample runs the sample of the GPM sampler, so that its duration is recorded
+// along the other queries.
+func (q *deviceQueries) gpmSample(sampler *gpmSampler, uuid string, metricIds []uint32) map[uint32]gpmValue {
+	value, _ := q.run(queryGpm, queryGpm, func() (interface{}, ixml.Return) {
+		return sampler.sample(uuid, q.device, metricIds), ixml.SUCCESS
+	})
+	return value.(map[uint32]gpmValue)
+}
@@ -0,0 +1,278 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"strconv"
+	"time"
+
+	"gitee.com/deep-spark/ixexporter/pkg/config"
+	"gitee.com/deep-spark/ixexporter/pkg/version"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// exporterMetrics are maintained by the exporter itself rather than read from
+// metrics config, they are always exported by iluvatarCollector.
+type exporterMetrics struct {
+	gpuPresent            *prometheus.GaugeVec
+	enumerationChanges    prometheus.Counter
+	ixmlUp                prometheus.Gauge
+	ixmlInitFailures      prometheus.Counter
+	xidErrors             *prometheus.CounterVec
+	xidLastTimestamp      *prometheus.GaugeVec
+	deviceCollectTimeouts *prometheus.CounterVec
+	queryDuration         *prometheus.HistogramVec
+	queryErrors           *prometheus.CounterVec
+	metricSupported       *prometheus.GaugeVec
+	snapshotGeneration    prometheus.Gauge
+	snapshotTimestamp     prometheus.Gauge
+	collectDuration       *prometheus.HistogramVec
+	lastSuccessfulCollect *prometheus.GaugeVec
+	collectTimeouts       *prometheus.CounterVec
+	scrapesCoalesced      prometheus.Counter
+	configReloadSuccess   prometheus.Gauge
+	configLastReload      prometheus.Gauge
+	buildInfo             *prometheus.Desc
+	driverInfo            *prometheus.Desc
+	driverMismatch        *prometheus.Desc
+	deviceInfo            *prometheus.Desc
+}
+
+func newExporterMetrics(naming *metricNaming) *exporterMetrics {
+	return &exporterMetrics{
+		gpuPresent: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        naming.name(GpuPresent),
+			Help:        "Whether the iluvatar GPU is present, 0 if it vanished since it was enumerated.",
+			ConstLabels: naming.constLabels,
+		}, LabelList),
+		enumerationChanges: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        naming.name(EnumerationChanges),
+			Help:        "The number of device enumerations which found a different set of GPUs.",
+			ConstLabels: naming.constLabels,
+		}),
+		ixmlUp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        naming.name(IxmlUp),
+			Help:        "Whether IXML is initialized and the devices are enumerated.",
+			ConstLabels: naming.constLabels,
+		}),
+		ixmlInitFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        naming.name(IxmlInitFailures),
+			Help:        "The number of failed IXML initializations.",
+			ConstLabels: naming.constLabels,
+		}),
+		xidErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        naming.name(XidErrorsTotal),
+			Help:        "The number of critical XID events of the iluvatar GPU, by XID.",
+			ConstLabels: naming.constLabels,
+		}, append(append([]string{}, LabelList...), LabelXid)),
+		xidLastTimestamp: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        naming.name(XidLastTimestamp),
+			Help:        "The unix time of the last critical XID event of the iluvatar GPU.",
+			ConstLabels: naming.constLabels,
+		}, LabelList),
+		deviceCollectTimeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        naming.name(DeviceCollectTimeouts),
+			Help:        "The number of collections of the iluvatar GPU which did not complete within the device timeout.",
+			ConstLabels: naming.constLabels,
+		}, LabelList),
+		queryDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        naming.name(DeviceQueryDuration),
+			Help:        "The duration of the device queries of the collections, by query.",
+			ConstLabels: naming.constLabels,
+			Buckets:     []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5},
+		}, []string{LabelQuery}),
+		queryErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        naming.name(DeviceQueryErrors),
+			Help:        "The number of failed reads of a metric of the iluvatar GPU, by IXML return code.",
+			ConstLabels: naming.constLabels,
+		}, append(append([]string{}, LabelList...), LabelMetric, LabelCode)),
+		metricSupported: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        naming.name(MetricSupported),
+			Help:        "Whether the metric is supported by the iluvatar GPU, 0 if its read returned ERROR_NOT_SUPPORTED.",
+			ConstLabels: naming.constLabels,
+		}, append(append([]string{}, LabelList...), LabelMetric)),
+		snapshotGeneration: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        naming.name(SnapshotGeneration),
+			Help:        "The number of the gpu metrics collections, the served metrics are those of the last one.",
+			ConstLabels: naming.constLabels,
+		}),
+		snapshotTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        naming.name(SnapshotTimestamp),
+			Help:        "The unix time of the collection of the served gpu metrics.",
+			ConstLabels: naming.constLabels,
+		}),
+		collectDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:        naming.name(CollectDuration),
+			Help:        "The duration of the collections of the subcollectors, by subcollector.",
+			ConstLabels: naming.constLabels,
+			Buckets:     []float64{.001, .005, .01, .05, .1, .5, 1, 5, 10, 30},
+		}, []string{LabelCollector}),
+		lastSuccessfulCollect: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name:        naming.name(LastSuccessfulCollect),
+			Help:        "The unix time of the last collection of the subcollector which completed without error or timeout.",
+			ConstLabels: naming.constLabels,
+		}, []string{LabelCollector}),
+		collectTimeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name:        naming.name(CollectTimeouts),
+			Help:        "The number of collections which did not complete in time, by subcollector or scrape.",
+			ConstLabels: naming.constLabels,
+		}, []string{LabelCollector}),
+		scrapesCoalesced: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        naming.name(ScrapesCoalesced),
+			Help:        "The number of scrapes which joined the collection in flight, or were served the last one within the minimum interval.",
+			ConstLabels: naming.constLabels,
+		}),
+		configReloadSuccess: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        naming.name(ConfigReloadSuccess),
+			Help:        "Whether the last reload of the metrics and cluster configs succeeded, the previous configs are kept otherwise.",
+			ConstLabels: naming.constLabels,
+		}),
+		configLastReload: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        naming.name(ConfigLastReload),
+			Help:        "The unix time of the last successful load of the metrics and cluster configs.",
+			ConstLabels: naming.constLabels,
+		}),
+		buildInfo: prometheus.NewDesc(naming.name(BuildInfo),
+			"The build information of the exporter, the value is always 1.",
+			[]string{LabelVersion, LabelCommit, LabelGoVersion}, naming.constLabels),
+		driverInfo: prometheus.NewDesc(naming.name(DriverInfo),
+			"The versions of the iluvatar driver stack, the value is always 1.",
+			[]string{LabelDriverVersion, LabelCudaVersion, LabelIxmlVersion}, naming.constLabels),
+		driverMismatch: prometheus.NewDesc(naming.name(DriverMismatch),
+			"Whether the version of a driver stack component differs from the expected one.",
+			[]string{LabelComponent, LabelExpected, LabelActual}, naming.constLabels),
+		deviceInfo: prometheus.NewDesc(naming.name(DeviceInfo),
+			"The identity of the iluvatar GPU read at enumeration, memory_total is in MiB, the value is always 1.",
+			append(append([]string{}, LabelList...), LabelPciBusId, LabelSerial, LabelBoardPartNumber,
+				LabelVbiosVersion, LabelMemoryTotal, LabelBoardPosition), naming.constLabels),
+	}
+}
+
+func (em *exporterMetrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		em.gpuPresent,
+		em.enumerationChanges,
+		em.ixmlUp,
+		em.ixmlInitFailures,
+		em.xidErrors,
+		em.xidLastTimestamp,
+		em.deviceCollectTimeouts,
+		em.queryDuration,
+		em.queryErrors,
+		em.metricSupported,
+		em.snapshotGeneration,
+		em.snapshotTimestamp,
+		em.collectDuration,
+		em.lastSuccessfulCollect,
+		em.collectTimeouts,
+		em.scrapesCoalesced,
+		em.configReloadSuccess,
+		em.configLastReload,
+	}
+}
+
+func (em *exporterMetrics) describe(ch chan<- *prometheus.Desc) {
+	for _, c := range em.collectors() {
+		c.Describe(ch)
+	}
+	ch <- em.buildInfo
+	ch <- em.driverInfo
+	ch <- em.driverMismatch
+	ch <- em.deviceInfo
+}
+
+func (em *exporterMetrics) collect(ch chan<- prometheus.Metric) {
+	for _, c := range em.collectors() {
+		c.Collect(ch)
+	}
+	ch <- prometheus.MustNewConstMetric(em.buildInfo, prometheus.GaugeValue, 1,
+		version.Version, version.Commit, version.GoVersion)
+}
+
+// observeCollect records the duration of a collection of the subcollector, and its
+// time if it succeeded.
+func (em *exporterMetrics) observeCollect(collector string, start time.Time, succeeded bool) {
+	now := time.Now()
+	em.collectDuration.WithLabelValues(collector).Observe(now.Sub(start).Seconds())
+	if succeeded {
+		em.lastSuccessfulCollect.WithLabelValues(collector).Set(float64(now.UnixNano()) / 1e9)
+	}
+}
+
+// deleteDevice deletes the series of the GPU kept by the exporter metrics, except
+// ix_gpu_present which tells that it vanished.
+func (em *exporterMetrics) deleteDevice(uuid string) {
+	labels := prometheus.Labels{LabelUuid: uuid}
+	em.xidErrors.DeletePartialMatch(labels)
+	em.xidLastTimestamp.DeletePartialMatch(labels)
+	em.deviceCollectTimeouts.DeletePartialMatch(labels)
+	em.queryErrors.DeletePartialMatch(labels)
+	em.metricSupported.DeletePartialMatch(labels)
+}
+
+// observeReload records the result of a load of the configs, and its time if it
+// succeeded.
+func (em *exporterMetrics) observeReload(succeeded bool) {
+	if !succeeded {
+		em.configReloadSuccess.Set(0)
+		return
+	}
+	em.configReloadSuccess.Set(1)
+	em.configLastReload.SetToCurrentTime()
+}
+
+// collectDriverInfo exports the driver stack versions read at the IXML initialization,
+// and one mismatch series per component which has an expected version.
+func (em *exporterMetrics) collectDriverInfo(ch chan<- prometheus.Metric, gpus iluvatarGPU, expected config.ExpectedVersions) {
+	if !gpus.initialized {
+		return
+	}
+
+	ch <- prometheus.MustNewConstMetric(em.driverInfo, prometheus.GaugeValue, 1,
+		gpus.driverVersion, gpus.cudaVersion, gpus.ixmlVersion)
+
+	checks := []struct {
+		component string
+		expected  string
+		actual    string
+	}{
+		{"driver", expected.Driver, gpus.driverVersion},
+		{"cuda", expected.Cuda, gpus.cudaVersion},
+		{"ixml", expected.Ixml, gpus.ixmlVersion},
+	}
+	for _, check := range checks {
+		if check.expected == "" {
+			continue
+		}
+		var mismatch float64
+		if check.expected != check.actual {
+			mismatch = 1
+		}
+		ch <- prometheus.MustNewConstMetric(em.driverMismatch, prometheus.GaugeValue, mismatch,
+			check.component, check.expected, check.actual)
+	}
+}
+
+func (em *exporterMetrics) collectDeviceInfo(ch chan<- prometheus.Metric, gpus iluvatarGPU) {
+	for uuid, gpu := range gpus.gpus {
+		ch <- prometheus.MustNewConstMetric(em.deviceInfo, prometheus.GaugeValue, 1,
+			strconv.FormatUint(uint64(gpu.index), 10), gpu.name, uuid,
+			gpu.pciBusId, gpu.serial, gpu.boardPartNumber, gpu.vbiosVersion,
+			strconv.FormatFloat(gpu.memoryTotal, 'f', -1, 64), gpu.boardPosition)
+	}
+}
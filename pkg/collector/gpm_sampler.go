@@ -0,0 +1,178 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"sync"
+
+	"gitee.com/deep-spark/go-ixml/pkg/ixml"
+	"gitee.com/deep-spark/ixexporter/pkg/logger"
+)
+
+// gpmMetrics maps the GPM metrics of metrics config to their GPM metric id.
+var gpmMetrics = map[string]uint32{
+	SmUtilization:            uint32(ixml.GPM_METRIC_SM_UTIL),
+	GpmGraphicsUtilization:   uint32(ixml.GPM_METRIC_GRAPHICS_UTIL),
+	GpmSmOccupancy:           uint32(ixml.GPM_METRIC_SM_OCCUPANCY),
+	GpmIntegerUtilization:    uint32(ixml.GPM_METRIC_INTEGER_UTIL),
+	GpmTensorUtilization:     uint32(ixml.GPM_METRIC_ANY_TENSOR_UTIL),
+	GpmDfmaTensorUtilization: uint32(ixml.GPM_METRIC_DFMA_TENSOR_UTIL),
+	GpmHmmaTensorUtilization: uint32(ixml.GPM_METRIC_HMMA_TENSOR_UTIL),
+	GpmImmaTensorUtilization: uint32(ixml.GPM_METRIC_IMMA_TENSOR_UTIL),
+	GpmDramBwUtilization:     uint32(ixml.GPM_METRIC_DRAM_BW_UTIL),
+	GpmFp64Utilization:       uint32(ixml.GPM_METRIC_FP64_UTIL),
+	GpmFp32Utilization:       uint32(ixml.GPM_METRIC_FP32_UTIL),
+	GpmFp16Utilization:       uint32(ixml.GPM_METRIC_FP16_UTIL),
+	GpmPcieTxBandwidth:       uint32(ixml.GPM_METRIC_PCIE_TX_PER_SEC),
+	GpmPcieRxBandwidth:       uint32(ixml.GPM_METRIC_PCIE_RX_PER_SEC),
+	GpmLinkTxBandwidth:       uint32(ixml.GPM_METRIC_NVLINK_TOTAL_TX_PER_SEC),
+	GpmLinkRxBandwidth:       uint32(ixml.GPM_METRIC_NVLINK_TOTAL_RX_PER_SEC),
+}
+
+// gpmSampler keeps the last GPM sample of each device, the GPM metrics of a
+// collection are computed between it and a new sample, so that a collection
+// does not have to wait between two samples. A kept sample is owned by the
+// sampler, the collection of the device takes it out while computing the metrics,
+// so that a reset never frees a sample in use by a late collection.
+type gpmSampler struct {
+	mutex     sync.Mutex
+	samples   map[string]gpmSample
+	supported map[string]bool
+	// generations are bumped by reset and forget, a sample taken in a previous
+	// generation of its device is freed rather than kept.
+	generations map[string]uint64
+}
+
+func newGpmSampler() *gpmSampler {
+	return &gpmSampler{
+		samples:     make(map[string]gpmSample),
+		supported:   make(map[string]bool),
+		generations: make(map[string]uint64),
+	}
+}
+
+// gpmValue is a GPM metric computed between two samples, ret is the return code of
+// the sample or the metric if either failed.
+type gpmValue struct {
+	value float64
+	ret   ixml.Return
+}
+
+// sample takes a new sample of the device and returns the given metrics since the
+// previous one, nothing is returned on the first sample of a device. Devices may
+// be sampled concurrently, but not a device with itself.
+func (gs *gpmSampler) sample(uuid string, device gpuDevice, metricIds []uint32) map[uint32]gpmValue {
+	gs.mutex.Lock()
+	supported, ok := gs.supported[uuid]
+	generation := gs.generations[uuid]
+	gs.generations[uuid] = generation
+	gs.mutex.Unlock()
+
+	if !ok {
+		support, ret := device.GpmQueryDeviceSupport()
+		if ret != ixml.SUCCESS && ret != ixml.ERROR_NOT_SUPPORTED {
+			// The support is queried again at the next sample.
+			return failedGpmValues(metricIds, ret)
+		}
+		supported = ret == ixml.SUCCESS && support
+		if !supported {
+			logger.IluvatarLog.Infof("GPU %s not support GPM", uuid)
+		}
+		gs.mutex.Lock()
+		if gs.generations[uuid] == generation {
+			gs.supported[uuid] = supported
+		}
+		gs.mutex.Unlock()
+	}
+	if !supported {
+		return failedGpmValues(metricIds, ixml.ERROR_NOT_SUPPORTED)
+	}
+
+	sample, ret := device.GpmSampleGet()
+	if ret != ixml.SUCCESS {
+		return failedGpmValues(metricIds, ret)
+	}
+
+	gs.mutex.Lock()
+	previous, ok := gs.samples[uuid]
+	delete(gs.samples, uuid)
+	ok = ok && gs.generations[uuid] == generation
+	gs.mutex.Unlock()
+	defer gs.keep(uuid, generation, sample)
+	if !ok {
+		return nil
+	}
+	defer previous.Free()
+
+	values := make(map[uint32]gpmValue, len(metricIds))
+	for _, metricId := range metricIds {
+		value, ret := device.GpmMetricGet(previous, sample, metricId)
+		values[metricId] = gpmValue{value: value, ret: ret}
+	}
+	return values
+}
+
+// failedGpmValues returns the return code of a failed sample for each metric.
+func failedGpmValues(metricIds []uint32, ret ixml.Return) map[uint32]gpmValue {
+	values := make(map[uint32]gpmValue, len(metricIds))
+	for _, metricId := range metricIds {
+		values[metricId] = gpmValue{ret: ret}
+	}
+	return values
+}
+
+// keep hands the sample back to the sampler as the previous sample of the next
+// collection, unless the device was reset or forgotten since it was taken.
+func (gs *gpmSampler) keep(uuid string, generation uint64, sample gpmSample) {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+
+	if gs.generations[uuid] != generation {
+		sample.Free()
+		return
+	}
+	gs.samples[uuid] = sample
+}
+
+// forget frees the kept sample of the device, which vanished.
+func (gs *gpmSampler) forget(uuid string) {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+
+	if sample, ok := gs.samples[uuid]; ok {
+		sample.Free()
+		delete(gs.samples, uuid)
+	}
+	delete(gs.supported, uuid)
+	gs.generations[uuid]++
+}
+
+// reset frees the kept samples, the devices are sampled from scratch afterward.
+func (gs *gpmSampler) reset() {
+	gs.mutex.Lock()
+	defer gs.mutex.Unlock()
+
+	for uuid, sample := range gs.samples {
+		sample.Free()
+		delete(gs.samples, uuid)
+	}
+	gs.supported = make(map[string]bool)
+	for uuid := range gs.generations {
+		gs.generations[uuid]++
+	}
+}
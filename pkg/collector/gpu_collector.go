@@ -18,7 +18,10 @@ limitations under the License.
 package collector
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"math"
 	"os"
 	"strconv"
 	"strings"
@@ -30,7 +33,17 @@ import (
 	"gitee.com/deep-spark/ixexporter/pkg/utils"
 )
 
-var metricCollectors = map[string]func(device ixml.Device) interface{}{
+const (
+	initRetryMinInterval = time.Second
+	initRetryMaxInterval = time.Minute
+)
+
+var errCollectTimeout = errors.New("collection timed out")
+
+// metricCollectors read a metric from the queries of the device, a query shared by
+// several metrics is made once per collection cycle. The value is a float64, or
+// a map of the 'reason' label to float64, or the []processInfo of ix_process_info.
+var metricCollectors = map[string]func(device *deviceQueries) (interface{}, ixml.Return){
 	Temperature:     collectTemperature,
 	FanSpeed:        collectFanSpeed,
 	SmClock:         collectSmClock,
@@ -42,50 +55,237 @@ var metricCollectors = map[string]func(device ixml.Device) interface{}{
 	GpuUtilization:  collectGPUUtilization,
 	PowerUsage:      collectPowerUsage,
 	ProcessInfo:     collectProcessInfo,
-	XidErrors:       collectXidErrors,
 	EccSbeVolStatus: collectEccSbeVolStatus,
 	EccDbeVolStatus: collectEccDbeVolStatus,
-	SmUtilization:   collectSmUtilization,
+
+	PcieTxThroughput: collectPcieTxThroughput,
+	PcieRxThroughput: collectPcieRxThroughput,
+	PcieReplayCount:  collectPcieReplayCount,
+	PcieLinkGen:      collectPcieLinkGen,
+	PcieLinkGenMax:   collectPcieLinkGenMax,
+	PcieLinkWidth:    collectPcieLinkWidth,
+	PcieLinkWidthMax: collectPcieLinkWidthMax,
+
+	ClockThrottleReason:   collectClockThrottleReasons,
+	ClockThrottleDuration: collectClockThrottleDurations,
+}
+
+// clocksThrottleReasons are the bits of the GetCurrentClocksThrottleReasons mask,
+// keyed by the value of the 'reason' label of ix_clock_throttle_reason.
+var clocksThrottleReasons = []struct {
+	reason string
+	mask   uint64
+}{
+	{"gpu_idle", 0x1},
+	{"applications_clocks_setting", 0x2},
+	{"sw_power_cap", 0x4},
+	{"hw_slowdown", 0x8},
+	{"sync_boost", 0x10},
+	{"sw_thermal_slowdown", 0x20},
+	{"hw_thermal_slowdown", 0x40},
+	{"hw_power_brake_slowdown", 0x80},
 }
 
 type gpuCollector struct {
-	mutex            sync.Mutex
-	gpus             iluvatarGPU
-	once             sync.Once
-	devices          map[string]ixml.Device
-	collectorConfigs []collectorConfig
+	mutex               sync.Mutex
+	inventory           *gpuInventory
+	once                sync.Once
+	backend             deviceBackend
+	devices             map[string]gpuDevice
+	known               map[string]gpuInfo
+	missing             map[string]gpuInfo
+	config              *configStore
+	active              *activeConfig
+	metrics             *exporterMetrics
+	xids                *xidLog
+	gpm                 *gpmSampler
+	cache               *metricCache
+	collecting          map[string]bool
+	served              uint64
+	unsupported         map[string]map[string]bool
+	readErrorNaN        bool
+	workers             int
+	deviceTimeout       time.Duration
+	enumerationInterval time.Duration
+}
+
+func newGpuCollector(config *configStore, inventory *gpuInventory, backend deviceBackend,
+	metrics *exporterMetrics, xids *xidLog, opts *Options) *gpuCollector {
+	return &gpuCollector{
+		inventory:           inventory,
+		backend:             backend,
+		config:              config,
+		devices:             make(map[string]gpuDevice),
+		known:               make(map[string]gpuInfo),
+		missing:             make(map[string]gpuInfo),
+		metrics:             metrics,
+		xids:                xids,
+		gpm:                 newGpmSampler(),
+		cache:               newMetricCache(),
+		collecting:          make(map[string]bool),
+		unsupported:         make(map[string]map[string]bool),
+		readErrorNaN:        opts.ReadErrorValue == ReadErrorNaN,
+		workers:             max(opts.CollectWorkers, 1),
+		deviceTimeout:       opts.DeviceTimeout,
+		enumerationInterval: opts.EnumerationInterval,
+	}
 }
 
-func registerGpuCollector(ctx *ixContext, collectorConfigs []collectorConfig, gpus iluvatarGPU) {
+func registerGpuCollector(ctx *ixContext, config *configStore, inventory *gpuInventory, backend deviceBackend,
+	metrics *exporterMetrics, xids *xidLog, opts *Options) {
 	var collector subCollector
 
-	collector = &gpuCollector{
-		gpus:             gpus,
-		collectorConfigs: collectorConfigs,
-		devices:          make(map[string]ixml.Device),
-	}
+	collector = newGpuCollector(config, inventory, backend, metrics, xids, opts)
 	ctx.registerCollector(collector)
+}
 
-	go collector.collect(ctx)
+// initDevices acquires the handles of all the enumerated devices, handles of a
+// previous enumeration are dropped since a reset device may not keep its handle.
+// The series, the GPM samples, the cached reads and the unsupported metrics of the
+// devices which vanished or moved to another index are dropped, those of the other
+// devices are kept.
+func (gc *gpuCollector) initDevices() {
+	gpus := gc.inventory.get().gpus
+	for uuid, gpu := range gc.known {
+		if current, ok := gpus[uuid]; !ok || current.index != gpu.index || current.name != gpu.name {
+			gc.metrics.deleteDevice(uuid)
+			gc.gpm.forget(uuid)
+			gc.cache.forget(uuid)
+			gc.mutex.Lock()
+			delete(gc.unsupported, uuid)
+			gc.mutex.Unlock()
+		}
+	}
+	gc.known = gpus
+
+	gc.devices = make(map[string]gpuDevice)
+	for uuid := range gpus {
+		device, ret := gc.backend.GetHandleByUUID(uuid)
+		if ret != ixml.SUCCESS {
+			logger.IluvatarLog.Logger.Errorf("Unable to get Handle by uuid %v", ret)
+			continue
+		}
+		gc.devices[uuid] = device
+	}
+	gc.updatePresence()
+}
+
+func (gc *gpuCollector) updatePresence() {
+	gc.metrics.gpuPresent.Reset()
+	for uuid, gpu := range gc.inventory.get().gpus {
+		gc.metrics.gpuPresent.WithLabelValues(strconv.FormatUint(uint64(gpu.index), 10), gpu.name, uuid).Set(1)
+	}
+	for uuid, gpu := range gc.missing {
+		gc.metrics.gpuPresent.WithLabelValues(strconv.FormatUint(uint64(gpu.index), 10), gpu.name, uuid).Set(0)
+	}
+}
+
+// initialize initializes IXML and enumerates the devices, it reports false if it
+// has to be retried.
+func (gc *gpuCollector) initialize() bool {
+	gpus, err := getDeviceInfo(gc.backend)
+	if err != nil {
+		logger.IluvatarLog.Errorf("Failed to initialize IXML: %v", err)
+		gc.metrics.ixmlInitFailures.Inc()
+		gc.metrics.ixmlUp.Set(0)
+		return false
+	}
+
+	gc.metrics.ixmlUp.Set(1)
+	gc.inventory.set(gpus)
+	gc.initDevices()
+	return true
+}
+
+// enumerate lists the devices again, so that a device which fell off the bus, was
+// reset or was added after a driver reload is noticed.
+func (gc *gpuCollector) enumerate() {
+	previous := gc.inventory.get()
+	current := previous
+	if err := enumerateDevices(gc.backend, &current); err != nil {
+		// The driver is likely gone, start over from the IXML initialization.
+		logger.IluvatarLog.Errorf("Failed to enumerate devices: %v", err)
+		if ret := gc.backend.Shutdown(); ret != ixml.SUCCESS {
+			logger.IluvatarLog.Warningf("Unable to shutdown IXML: %v", ret)
+		}
+		gc.metrics.ixmlUp.Set(0)
+		gc.inventory.set(iluvatarGPU{})
+		gc.gpm.reset()
+		gc.cache.reset()
+		gc.devices = make(map[string]gpuDevice)
+		return
+	}
+
+	changed := false
+	for uuid, gpu := range previous.gpus {
+		if _, ok := current.gpus[uuid]; !ok {
+			logger.IluvatarLog.Warningf("GPU %s (%s) vanished", uuid, gpu.name)
+			for _, event := range gc.xids.recent(uuid) {
+				logger.IluvatarLog.Warningf("GPU %s had XID %d at %v", uuid, event.xid, event.timestamp)
+			}
+			gc.missing[uuid] = gpu
+			changed = true
+		}
+	}
+	for uuid, gpu := range current.gpus {
+		if _, ok := previous.gpus[uuid]; !ok {
+			logger.IluvatarLog.Infof("GPU %s (%s) appeared at index %d", uuid, gpu.name, gpu.index)
+			changed = true
+		}
+		delete(gc.missing, uuid)
+	}
+	if changed {
+		gc.metrics.enumerationChanges.Inc()
+	}
+
+	gc.inventory.set(current)
+	gc.initDevices()
 }
 
 func (gc *gpuCollector) collect(ctx *ixContext) {
 	gc.once.Do(func() {
-		for uuid, _ := range gc.gpus.gpus {
-			device, ret := ixml.GetHandleByUUID(uuid)
-			if ret != ixml.SUCCESS {
-				logger.IluvatarLog.Logger.Errorf("Unable to get Handle by uuid %v", ret)
-				continue
-			}
-			gc.devices[uuid] = device
+		if gc.inventory.get().initialized {
+			gc.initDevices()
 		}
 	})
 
+	var rescan <-chan time.Time
+	if gc.enumerationInterval > 0 {
+		ticker := time.NewTicker(gc.enumerationInterval)
+		defer ticker.Stop()
+		rescan = ticker.C
+	}
+
+	// IXML is initialized at once, then retried with an exponential backoff.
+	var retry <-chan time.Time
+	backoff := initRetryMinInterval
+	if !gc.inventory.get().initialized {
+		retry = time.After(0)
+	}
+
 	for {
 		select {
 		case <-ctx.done():
 			return
-		case <-ctx.signal():
+		case <-retry:
+			if gc.initialize() {
+				retry = nil
+				backoff = initRetryMinInterval
+				continue
+			}
+			logger.IluvatarLog.Infof("Retry to initialize IXML in %v", backoff)
+			retry = time.After(backoff)
+			backoff = min(2*backoff, initRetryMaxInterval)
+		case <-rescan:
+			if !gc.inventory.get().initialized {
+				continue
+			}
+			logger.IluvatarLog.Infoln("Start to enumerate gpu devices")
+			gc.enumerate()
+			if !gc.inventory.get().initialized {
+				retry = time.After(backoff)
+			}
+		case <-ctx.signal(gc.served):
 			logger.IluvatarLog.Infoln("Start to collect gpu metrics")
 			gc.collectMetrics(ctx)
 		}
@@ -98,189 +298,387 @@ func (gc *gpuCollector) setLabelValue(key, value string) map[string]string {
 	}
 }
 
+// collectMetrics collects the gpu metrics of the current round, the round is
+// finished once they are stored.
 func (gc *gpuCollector) collectMetrics(ctx *ixContext) {
-	metrics := make(map[string][]metric)
-
-	for uuid, gpu := range gc.gpus.gpus {
-		device, ok := gc.devices[uuid]
-		if !ok {
-			logger.IluvatarLog.Logger.Errorf("Device not found for uuid: %s", uuid)
-			continue
-		}
-
-		baseLabels := map[string]string{
-			LabelUuid: uuid,
-			LabelName: gpu.name,
-			LabelGPU:  strconv.FormatUint(uint64(gpu.index), 10),
-		}
-
-		for _, config := range gc.collectorConfigs {
-			if collectFunc, ok := metricCollectors[config.Name]; ok {
-				var value float64
-				var collectedValue interface{}
-				var isProcessInfo bool
+	start := time.Now()
+	gpus := gc.inventory.get()
+	round := ctx.currentRound()
+	gc.served = round.id
+	defer ctx.finishRound(round)
+
+	// A collection reads the metrics of the config active at its start. The reads
+	// cached and the GPM samples taken for a previous config are dropped, since its
+	// intervals and GPM metrics may differ.
+	active := gc.config.get()
+	if gc.active != nil && gc.active != active {
+		logger.IluvatarLog.Infof("Metrics config changed, %d gpu metrics", len(active.collectorConfigs))
+		gc.cache.reset()
+		gc.gpm.reset()
+	}
+	gc.active = active
 
-				if config.Name == ProcessInfo {
-					isProcessInfo = true
-					collectedValue = collectFunc(device)
-				} else {
-					if config.Name == SmUtilization {
-						gpuQuerySupport, ret := device.GpmQueryDeviceSupport()
-						if ret != ixml.SUCCESS || gpuQuerySupport.IsSupportedDevice == 0 {
-							continue
-						}
-					}
-					collectedValue = collectFunc(device)
-					value, ok = collectedValue.(float64)
-					if !ok {
-						logger.IluvatarLog.Logger.Errorln("collectFunc returned non-float64")
-						continue
-					}
-				}
+	collectCtx, cancel := ctx.collectContext(round)
+	defer cancel()
 
-				if isProcessInfo {
-					infos, ok := collectedValue.([]ixml.Info)
-					if !ok {
-						logger.IluvatarLog.Logger.Errorln("collectFunc returned non-ProcessInfo")
-						continue
-					}
-					if len(infos) == 0 {
-						pidLabels := make(map[string]string, len(baseLabels)+2)
-						for k, v := range baseLabels {
-							pidLabels[k] = v
-						}
-						pidLabels[LabelProcessPid] = ""
-						pidLabels[LabelProcessName] = ""
-						metrics[uuid] = append(metrics[uuid], metric{
-							name:   config.Name,
-							labels: pidLabels,
-							value:  0,
-						})
-					}
-					for _, info := range infos {
-						pidLabels := make(map[string]string, len(baseLabels)+2)
-						for k, v := range baseLabels {
-							pidLabels[k] = v
-						}
-						pidLabels[LabelProcessPid] = strconv.FormatUint(uint64(info.Pid), 10)
-						pidLabels[LabelProcessName] = getProcessNameByPid(info.Pid)
-						value = float64(info.UsedGpuMemory / 1024 / 1024) // to MiB
-						metrics[uuid] = append(metrics[uuid], metric{
-							name:   config.Name,
-							labels: pidLabels,
-							value:  value,
-						})
-					}
+	var mutex sync.Mutex
+	metrics := make(map[string][]metric)
+	failed, timedOut := false, false
+
+	workers := min(gc.workers, len(gpus.gpus))
+	uuids := make(chan string)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for uuid := range uuids {
+				ms, err := gc.collectDeviceWithDeadline(collectCtx, active, uuid, gpus.gpus[uuid])
+				mutex.Lock()
+				if err == nil {
+					metrics[uuid] = ms
 				} else {
-					metrics[uuid] = append(metrics[uuid], metric{
-						name:   config.Name,
-						labels: baseLabels,
-						value:  value,
-					})
+					failed = true
+					timedOut = timedOut || errors.Is(err, errCollectTimeout)
 				}
+				mutex.Unlock()
 			}
+		}()
+	}
+
+	// The GPUs not started before the collection is cancelled are left out, the
+	// collected ones are stored as a partial result.
+	cancelled := false
+dispatch:
+	for uuid := range gpus.gpus {
+		select {
+		case uuids <- uuid:
+		case <-collectCtx.Done():
+			cancelled = true
+			break dispatch
 		}
 	}
+	close(uuids)
+	wg.Wait()
+
 	ctx.updateMetrics(metrics)
+
+	if cancelled {
+		logger.IluvatarLog.Warningf("Collecting gpu metrics cancelled: %v, %d of %d GPUs collected",
+			collectCtx.Err(), len(metrics), len(gpus.gpus))
+		failed = true
+		timedOut = timedOut || errors.Is(collectCtx.Err(), context.DeadlineExceeded)
+	}
+	if timedOut {
+		gc.metrics.collectTimeouts.WithLabelValues(CollectorGpu).Inc()
+	}
+	gc.metrics.observeCollect(CollectorGpu, start, gpus.initialized && !failed)
 }
 
-func collectTemperature(device ixml.Device) interface{} {
-	temperature, ret := device.GetTemperature()
-	if ret != ixml.SUCCESS {
-		logger.IluvatarLog.Logger.Warningf("Unable to get GPU temperature of device: %v", ret)
+// collectDeviceWithDeadline collects the device within the device timeout and the
+// context, it returns errCollectTimeout if the device is not collected in time.
+// Since an IXML call can not be interrupted, a device is not collected again until
+// its late collection returns, whose result is dropped.
+func (gc *gpuCollector) collectDeviceWithDeadline(ctx context.Context, active *activeConfig, uuid string,
+	gpu gpuInfo) ([]metric, error) {
+	device, ok := gc.devices[uuid]
+	if !ok {
+		logger.IluvatarLog.Logger.Errorf("Device not found for uuid: %s", uuid)
+		return nil, fmt.Errorf("device not found for uuid: %s", uuid)
+	}
 
+	index := strconv.FormatUint(uint64(gpu.index), 10)
+
+	gc.mutex.Lock()
+	if gc.collecting[uuid] {
+		gc.mutex.Unlock()
+		logger.IluvatarLog.Warningf("GPU %s (%s) is still being collected, skip it", uuid, gpu.name)
+		gc.metrics.deviceCollectTimeouts.WithLabelValues(index, gpu.name, uuid).Inc()
+		return nil, errCollectTimeout
 	}
-	return float64(temperature)
-}
+	gc.collecting[uuid] = true
+	gc.mutex.Unlock()
+
+	done := make(chan deviceResult, 1)
+	go func() {
+		defer func() {
+			gc.mutex.Lock()
+			delete(gc.collecting, uuid)
+			gc.mutex.Unlock()
+		}()
+		done <- gc.collectDevice(active, uuid, gpu, device)
+	}()
 
-func collectFanSpeed(device ixml.Device) interface{} {
-	speed, ret := device.GetFanSpeed()
-	if ret != ixml.SUCCESS {
-		logger.IluvatarLog.Logger.Warningf("Unable to get GPU FanSpeed of device: %v", ret)
-		return 0
+	var timeout <-chan time.Time
+	if gc.deviceTimeout > 0 {
+		timer := time.NewTimer(gc.deviceTimeout)
+		defer timer.Stop()
+		timeout = timer.C
 	}
 
-	return float64(speed)
+	select {
+	case result := <-done:
+		gc.record(uuid, gpu, result)
+		return result.metrics, nil
+	case <-timeout:
+		logger.IluvatarLog.Errorf("Collecting GPU %s (%s) timed out after %v", uuid, gpu.name, gc.deviceTimeout)
+		gc.metrics.deviceCollectTimeouts.WithLabelValues(index, gpu.name, uuid).Inc()
+		return nil, errCollectTimeout
+	case <-ctx.Done():
+		logger.IluvatarLog.Errorf("Collecting GPU %s (%s) cancelled: %v", uuid, gpu.name, ctx.Err())
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			gc.metrics.deviceCollectTimeouts.WithLabelValues(index, gpu.name, uuid).Inc()
+			return nil, errCollectTimeout
+		}
+		return nil, ctx.Err()
+	}
 }
 
-func collectSmClock(device ixml.Device) interface{} {
-	clock, ret := device.GetClockInfo()
-	if ret != ixml.SUCCESS {
-		logger.IluvatarLog.Logger.Warningf("Unable to get GPU SmClock of device: %v", ret)
-		return 0
-	}
+// deviceResult is the result of the collection of a device. The collection only
+// reads the state shared with the other collections, its reads and the metrics to
+// cache are recorded once it completes in time, so that a late collection does not
+// change the state of the next cycles.
+type deviceResult struct {
+	metrics []metric
+	reads   []metricRead
+	cached  []cachedRead
+}
 
-	return float64(clock.Sm)
+// metricRead is the return code of the read of a metric from the device.
+type metricRead struct {
+	name string
+	ret  ixml.Return
 }
 
-func collectMemClock(device ixml.Device) interface{} {
-	clock, ret := device.GetClockInfo()
-	if ret != ixml.SUCCESS {
-		logger.IluvatarLog.Logger.Warningf("Unable to get GPU MemsClock of device: %v", ret)
-		return 0
+// cachedRead holds the metrics of a successful read, to cache by their config.
+type cachedRead struct {
+	config  collectorConfig
+	metrics []metric
+}
+
+// record records the reads of a collection of the device.
+func (gc *gpuCollector) record(uuid string, gpu gpuInfo, result deviceResult) {
+	for _, read := range result.reads {
+		gc.recordRead(uuid, gpu, read.name, read.ret)
+	}
+	for _, cached := range result.cached {
+		gc.cache.set(uuid, cached.config, cached.metrics)
 	}
+}
 
-	return float64(clock.Mem)
+// recordRead records the result of the read of the metric. A metric which is not
+// supported by the device is logged once, other failures are counted by return
+// code.
+func (gc *gpuCollector) recordRead(uuid string, gpu gpuInfo, name string, ret ixml.Return) {
+	index := strconv.FormatUint(uint64(gpu.index), 10)
+
+	switch ret {
+	case ixml.SUCCESS:
+		gc.metrics.metricSupported.WithLabelValues(index, gpu.name, uuid, name).Set(1)
+	case ixml.ERROR_NOT_SUPPORTED:
+		gc.metrics.metricSupported.WithLabelValues(index, gpu.name, uuid, name).Set(0)
+		gc.mutex.Lock()
+		if gc.unsupported[uuid] == nil {
+			gc.unsupported[uuid] = make(map[string]bool)
+		}
+		logged := gc.unsupported[uuid][name]
+		gc.unsupported[uuid][name] = true
+		gc.mutex.Unlock()
+		if !logged {
+			logger.IluvatarLog.Infof("GPU %s (%s) not support %s", uuid, gpu.name, name)
+		}
+	default:
+		logger.IluvatarLog.Warningf("Unable to get %s of GPU %s (%s): %v", name, uuid, gpu.name, ret)
+		gc.metrics.queryErrors.WithLabelValues(index, gpu.name, uuid, name, returnCodeName(ret)).Inc()
+	}
 }
 
-func collectTotalMemory(device ixml.Device) interface{} {
-	mem, ret := device.GetMemoryInfo()
-	if ret != ixml.SUCCESS {
-		logger.IluvatarLog.Logger.Warningf("Unable to get GPU MemoryInfo of device: %v", ret)
-		return 0
+func (gc *gpuCollector) collectDevice(active *activeConfig, uuid string, gpu gpuInfo, device gpuDevice) deviceResult {
+	var result deviceResult
+
+	baseLabels := map[string]string{
+		LabelUuid: uuid,
+		LabelName: gpu.name,
+		LabelGPU:  strconv.FormatUint(uint64(gpu.index), 10),
 	}
 
-	return float64(mem.Total)
-}
+	queries := newDeviceQueries(device, gc.metrics)
 
-func collectUsedMemory(device ixml.Device) interface{} {
-	mem, ret := device.GetMemoryInfo()
-	if ret != ixml.SUCCESS {
-		logger.IluvatarLog.Logger.Warningf("Unable to get GPU MemoryInfo of device: %v", ret)
-		return 0
+	var gpmValues map[uint32]gpmValue
+	if len(active.gpmMetricIds) > 0 {
+		gpmValues = queries.gpmSample(gc.gpm, uuid, active.gpmMetricIds)
 	}
 
-	return float64(mem.Used)
+	for _, config := range active.collectorConfigs {
+		if ms, ok := gc.cache.get(uuid, config.Name); ok {
+			result.metrics = append(result.metrics, ms...)
+			continue
+		}
+
+		ms, ok := gc.collectMetric(uuid, config, queries, baseLabels, gpmValues, &result)
+		if ok {
+			result.cached = append(result.cached, cachedRead{config: config, metrics: ms})
+		}
+		result.metrics = append(result.metrics, ms...)
+	}
+	return result
 }
 
-func collectFreeMemory(device ixml.Device) interface{} {
-	mem, ret := device.GetMemoryInfo()
+// collectMetric reads the metric of the device, the read is added to the result.
+// It reports false if the read failed.
+func (gc *gpuCollector) collectMetric(uuid string, config collectorConfig, queries *deviceQueries,
+	baseLabels map[string]string, gpmValues map[uint32]gpmValue, result *deviceResult) ([]metric, bool) {
+	var metrics []metric
+
+	// The last XID is kept by the xid collector rather than read from the device.
+	if config.Name == XidErrors {
+		var value float64
+		if event, ok := gc.xids.lastEvent(uuid); ok {
+			value = float64(event.xid)
+		}
+		metrics = append(metrics, metric{
+			name:   config.Name,
+			labels: baseLabels,
+			value:  value,
+		})
+		return metrics, true
+	}
+
+	collectedValue, ret, ok := readMetric(config.Name, queries, gpmValues)
+	if !ok {
+		return nil, false
+	}
+	result.reads = append(result.reads, metricRead{name: config.Name, ret: ret})
 	if ret != ixml.SUCCESS {
-		logger.IluvatarLog.Logger.Warningf("Unable to get GPU MemoryInfo of device: %v", ret)
-		return 0
+		if ret != ixml.ERROR_NOT_SUPPORTED && gc.readErrorNaN && len(MetricExtraLabels[config.Name]) == 0 {
+			metrics = append(metrics, metric{
+				name:   config.Name,
+				labels: baseLabels,
+				value:  math.NaN(),
+			})
+		}
+		return metrics, false
 	}
 
-	return float64(mem.Free)
+	switch value := collectedValue.(type) {
+	case float64:
+		metrics = append(metrics, metric{
+			name:   config.Name,
+			labels: baseLabels,
+			value:  value,
+		})
+	case map[string]float64:
+		for reason, v := range value {
+			reasonLabels := make(map[string]string, len(baseLabels)+1)
+			for k, v := range baseLabels {
+				reasonLabels[k] = v
+			}
+			reasonLabels[LabelReason] = reason
+			metrics = append(metrics, metric{
+				name:   config.Name,
+				labels: reasonLabels,
+				value:  v,
+			})
+		}
+	case []processInfo:
+		if len(value) == 0 {
+			pidLabels := make(map[string]string, len(baseLabels)+2)
+			for k, v := range baseLabels {
+				pidLabels[k] = v
+			}
+			pidLabels[LabelProcessPid] = ""
+			pidLabels[LabelProcessName] = ""
+			metrics = append(metrics, metric{
+				name:   config.Name,
+				labels: pidLabels,
+				value:  0,
+			})
+		}
+		for _, info := range value {
+			pidLabels := make(map[string]string, len(baseLabels)+2)
+			for k, v := range baseLabels {
+				pidLabels[k] = v
+			}
+			pidLabels[LabelProcessPid] = strconv.FormatUint(uint64(info.pid), 10)
+			pidLabels[LabelProcessName] = getProcessNameByPid(info.pid)
+			metrics = append(metrics, metric{
+				name:   config.Name,
+				labels: pidLabels,
+				value:  float64(info.usedGpuMemory / 1024 / 1024), // to MiB
+			})
+		}
+	default:
+		logger.IluvatarLog.Logger.Errorf("collectFunc of %s returned %T", config.Name, collectedValue)
+		return nil, false
+	}
+	return metrics, true
 }
 
-func collectPowerUsage(device ixml.Device) interface{} {
-	usage, ret := device.GetPowerUsage()
-	if ret != ixml.SUCCESS {
-		logger.IluvatarLog.Logger.Warningf("Unable to get usage %v", ret)
-		return 0
+// readMetric reads the metric from the queries of the device, or from the GPM
+// values. It reports false if there is nothing to read, e.g. a GPM metric on the
+// first sample of the device.
+func readMetric(name string, queries *deviceQueries, gpmValues map[uint32]gpmValue) (interface{}, ixml.Return, bool) {
+	if metricId, ok := gpmMetrics[name]; ok {
+		result, ok := gpmValues[metricId]
+		return result.value, result.ret, ok
 	}
 
-	return float64(usage)
+	collectFunc, ok := metricCollectors[name]
+	if !ok {
+		return nil, ixml.SUCCESS, false
+	}
+	value, ret := collectFunc(queries)
+	return value, ret, true
 }
 
-func collectMemUtilization(device ixml.Device) interface{} {
-	utilization, ret := device.GetUtilizationRates()
-	if ret != ixml.SUCCESS {
-		logger.IluvatarLog.Logger.Warningf("Unable to get GPU Memory utilizationRates of device %v", ret)
-		return 0
-	}
+func collectTemperature(device *deviceQueries) (interface{}, ixml.Return) {
+	temperature, ret := device.GetTemperature()
+	return float64(temperature), ret
+}
+
+func collectFanSpeed(device *deviceQueries) (interface{}, ixml.Return) {
+	speed, ret := device.GetFanSpeed()
+	return float64(speed), ret
+}
+
+func collectSmClock(device *deviceQueries) (interface{}, ixml.Return) {
+	clock, ret := device.GetClockInfo()
+	return float64(clock.sm), ret
+}
+
+func collectMemClock(device *deviceQueries) (interface{}, ixml.Return) {
+	clock, ret := device.GetClockInfo()
+	return float64(clock.mem), ret
+}
+
+func collectTotalMemory(device *deviceQueries) (interface{}, ixml.Return) {
+	mem, ret := device.GetMemoryInfo()
+	return float64(mem.total), ret
+}
 
-	return float64(utilization.Memory)
+func collectUsedMemory(device *deviceQueries) (interface{}, ixml.Return) {
+	mem, ret := device.GetMemoryInfo()
+	return float64(mem.used), ret
+}
+
+func collectFreeMemory(device *deviceQueries) (interface{}, ixml.Return) {
+	mem, ret := device.GetMemoryInfo()
+	return float64(mem.free), ret
+}
+
+func collectPowerUsage(device *deviceQueries) (interface{}, ixml.Return) {
+	usage, ret := device.GetPowerUsage()
+	return float64(usage), ret
 }
 
-func collectGPUUtilization(device ixml.Device) interface{} {
+func collectMemUtilization(device *deviceQueries) (interface{}, ixml.Return) {
 	utilization, ret := device.GetUtilizationRates()
-	if ret != ixml.SUCCESS {
-		logger.IluvatarLog.Logger.Warningf("Unable to get GPU utilizationRates of device %v", ret)
-		return 0
-	}
+	return float64(utilization.memory), ret
+}
 
-	return float64(utilization.Gpu)
+func collectGPUUtilization(device *deviceQueries) (interface{}, ixml.Return) {
+	utilization, ret := device.GetUtilizationRates()
+	return float64(utilization.gpu), ret
 }
 
 func getProcessNameByPid(pid uint32) string {
@@ -299,84 +697,88 @@ func getProcessNameByPid(pid uint32) string {
 	return strings.TrimSuffix(string(data), "\x00")
 }
 
-func collectProcessInfo(device ixml.Device) interface{} {
-	processInfos, ret := device.GetComputeRunningProcesses()
+func collectProcessInfo(device *deviceQueries) (interface{}, ixml.Return) {
+	return device.GetComputeRunningProcesses()
+}
+
+func collectClockThrottleReasons(device *deviceQueries) (interface{}, ixml.Return) {
+	mask, ret := device.GetCurrentClocksThrottleReasons()
 	if ret != ixml.SUCCESS {
-		logger.IluvatarLog.Logger.Warningf("Unable to get processInfos: %v", ret)
-		return nil
+		return nil, ret
+	}
+
+	reasons := make(map[string]float64, len(clocksThrottleReasons))
+	for _, r := range clocksThrottleReasons {
+		reasons[r.reason] = 0
+		if mask&r.mask != 0 {
+			reasons[r.reason] = 1
+		}
 	}
-	return processInfos
+	return reasons, ixml.SUCCESS
 }
 
-func collectXidErrors(device ixml.Device) interface{} {
-	clocksThrottleReasons, ret := device.GetCurrentClocksThrottleReasons()
-	if ret != ixml.SUCCESS {
-		logger.IluvatarLog.Logger.Warningf("Unable to get clocksThrottleReasons: %v", ret)
-		return nil
+// collectClockThrottleDurations reports the time spent throttled of each policy
+// the device keeps track of, the others are left out.
+func collectClockThrottleDurations(device *deviceQueries) (interface{}, ixml.Return) {
+	durations := make(map[string]float64)
+	failure := ixml.ERROR_NOT_SUPPORTED
+	for _, policy := range violationPolicies {
+		duration, ret := device.GetViolationTime(policy)
+		if ret != ixml.SUCCESS {
+			if ret != ixml.ERROR_NOT_SUPPORTED {
+				failure = ret
+			}
+			continue
+		}
+		durations[string(policy)] = time.Duration(duration).Seconds()
+	}
+	if len(durations) == 0 {
+		return nil, failure
 	}
-	return float64(clocksThrottleReasons)
+	return durations, ixml.SUCCESS
 }
 
-func collectEccSbeVolStatus(device ixml.Device) interface{} {
+func collectEccSbeVolStatus(device *deviceQueries) (interface{}, ixml.Return) {
 	singleErr, _, ret := device.GetEccErros()
-	if ret != ixml.SUCCESS {
-		logger.IluvatarLog.Logger.Warningf("Unable to get ECC SBE Volatile: %v", ret)
-		return nil
-	}
-	return float64(singleErr)
+	return float64(singleErr), ret
 }
 
-func collectEccDbeVolStatus(device ixml.Device) interface{} {
+func collectEccDbeVolStatus(device *deviceQueries) (interface{}, ixml.Return) {
 	_, doubleErr, ret := device.GetEccErros()
-	if ret != ixml.SUCCESS {
-		logger.IluvatarLog.Logger.Warningf("Unable to get ECC DBE Volatile: %v", ret)
-		return nil
-	}
-	return float64(doubleErr)
+	return float64(doubleErr), ret
 }
 
-func collectSmUtilization(device ixml.Device) interface{} {
-	sample1, ret := ixml.GpmSampleAlloc()
-	if ret != ixml.SUCCESS {
-		logger.IluvatarLog.Logger.Warningf("Unable to allocate GPM sample: %v", ret)
-		return nil
-	}
-	defer func() {
-		_ = sample1.Free()
-	}()
-	sample2, ret := ixml.GpmSampleAlloc()
-	if ret != ixml.SUCCESS {
-		logger.IluvatarLog.Logger.Warningf("Unable to allocate GPM sample: %v", ret)
-		return nil
-	}
-	defer func() {
-		_ = sample2.Free()
-	}()
+func collectPcieTxThroughput(device *deviceQueries) (interface{}, ixml.Return) {
+	throughput, ret := device.GetPcieThroughput()
+	return float64(throughput.tx), ret
+}
 
-	if ret := device.GpmSampleGet(sample1); ret != ixml.SUCCESS {
-		logger.IluvatarLog.Logger.Warningf("could not get GPM sample: %w", ret)
-		return nil
-	}
-	time.Sleep(1 * time.Second)
-	if ret := device.GpmSampleGet(sample2); ret != ixml.SUCCESS {
-		logger.IluvatarLog.Logger.Warningf("could not get GPM sample: %w", ret)
-		return nil
-	}
+func collectPcieRxThroughput(device *deviceQueries) (interface{}, ixml.Return) {
+	throughput, ret := device.GetPcieThroughput()
+	return float64(throughput.rx), ret
+}
 
-	gpmMetric := ixml.GpmMetricsGetType{
-		NumMetrics: 1,
-		Sample1:    sample1,
-		Sample2:    sample2,
-		Metrics: [98]ixml.GpmMetric{
-			{
-				MetricId: uint32(ixml.GPM_METRIC_SM_UTIL),
-			},
-		},
-	}
-	ret = ixml.GpmMetricsGet(&gpmMetric)
-	if ret != ixml.SUCCESS {
-		return fmt.Errorf("failed to get gpm metric: %w", ret)
-	}
+func collectPcieReplayCount(device *deviceQueries) (interface{}, ixml.Return) {
+	count, ret := device.GetPcieReplayCounter()
+	return float64(count), ret
+}
+
+func collectPcieLinkGen(device *deviceQueries) (interface{}, ixml.Return) {
+	link, ret := device.GetPcieLinkInfo()
+	return float64(link.currGeneration), ret
+}
+
+func collectPcieLinkGenMax(device *deviceQueries) (interface{}, ixml.Return) {
+	link, ret := device.GetPcieLinkInfo()
+	return float64(link.maxGeneration), ret
+}
+
+func collectPcieLinkWidth(device *deviceQueries) (interface{}, ixml.Return) {
+	link, ret := device.GetPcieLinkInfo()
+	return float64(link.currWidth), ret
+}
 
-	return float64(gpmMetric.Metrics[0].Value)
+func collectPcieLinkWidthMax(device *deviceQueries) (interface{}, ixml.Return) {
+	link, ret := device.GetPcieLinkInfo()
+	return float64(link.maxWidth), ret
 }
@@ -0,0 +1,50 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"sync"
+)
+
+// gpuInventory holds the devices of the last enumeration, shared by the gpu and
+// kubernetes collectors. The maps of an iluvatarGPU are never modified once it is
+// stored, a new enumeration replaces them.
+type gpuInventory struct {
+	mutex sync.RWMutex
+	gpus  iluvatarGPU
+}
+
+func newGpuInventory(gpus iluvatarGPU) *gpuInventory {
+	return &gpuInventory{gpus: gpus}
+}
+
+func (inv *gpuInventory) get() iluvatarGPU {
+	inv.mutex.RLock()
+	defer inv.mutex.RUnlock()
+
+	return inv.gpus
+}
+
+// set stores the devices of a new enumeration under the next generation.
+func (inv *gpuInventory) set(gpus iluvatarGPU) {
+	inv.mutex.Lock()
+	defer inv.mutex.Unlock()
+
+	gpus.generation = inv.gpus.generation + 1
+	inv.gpus = gpus
+}
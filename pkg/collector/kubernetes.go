@@ -19,6 +19,9 @@ package collector
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"io/fs"
 	"net"
 	"os"
 	"sync"
@@ -28,16 +31,20 @@ import (
 	"gitee.com/deep-spark/ixexporter/pkg/logger"
 	"gitee.com/deep-spark/ixexporter/pkg/utils"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	podresourcesapi "k8s.io/kubelet/pkg/apis/podresources/v1alpha1"
 )
 
+// Defaults of the kubernetes options.
 const (
-	socket               = "/var/lib/kubelet/pod-resources/kubelet.sock"
-	iluvatarResourceName = "iluvatar.com/gpu"
-	ConfigFile           = "/iluvatar-config/ix-config"
+	DefaultKubeletSocket = "/var/lib/kubelet/pod-resources/kubelet.sock"
+	DefaultResourceName  = "iluvatar.com/gpu"
+	DefaultClusterConfig = "/iluvatar-config/ix-config"
+	DefaultKubeTimeout   = 10 * time.Second
 )
 
 type gpuPod struct {
@@ -47,12 +54,16 @@ type gpuPod struct {
 }
 
 type kubeCollector struct {
-	clientset  kubernetes.Interface
-	gpus       iluvatarGPU
-	once       sync.Once
-	conn       *grpc.ClientConn
-	timeout    time.Duration
-	SplitBoard bool
+	clientset    kubernetes.Interface
+	config       *configStore
+	inventory    *gpuInventory
+	metrics      *exporterMetrics
+	once         sync.Once
+	conn         *grpc.ClientConn
+	socket       string
+	resourceName string
+	timeout      time.Duration
+	served       uint64
 }
 
 func initClientSet() kubernetes.Interface {
@@ -71,14 +82,14 @@ func (kc *kubeCollector) collect(ctx *ixContext) {
 	kc.once.Do(func() {
 		var err error
 
-		ret := utils.ValidatePath(socket)
+		ret := utils.ValidatePath(kc.socket)
 		if !ret {
-			logger.IluvatarLog.Errorf("Failed to find '%s'\n", socket)
+			logger.IluvatarLog.Errorf("Failed to find '%s'\n", kc.socket)
 			return
 		}
 		kc.clientset = initClientSet()
 
-		kc.conn, err = kc.connectToKubelet(socket)
+		kc.conn, err = kc.connectToKubelet(kc.socket)
 		if err != nil {
 			logger.IluvatarLog.Errorln(err)
 			return
@@ -90,9 +101,11 @@ func (kc *kubeCollector) collect(ctx *ixContext) {
 		case <-ctx.done():
 			// Close the gRPC connection.
 			logger.IluvatarLog.Infoln("Disconnect to kubelet")
-			kc.conn.Close()
+			if kc.conn != nil {
+				kc.conn.Close()
+			}
 			return
-		case <-ctx.signal():
+		case <-ctx.signal(kc.served):
 			logger.IluvatarLog.Infoln("Start to collect kubernetes metrics")
 			kc.collectMetrics(ctx)
 		}
@@ -100,15 +113,24 @@ func (kc *kubeCollector) collect(ctx *ixContext) {
 }
 
 func (kc *kubeCollector) collectMetrics(ctx *ixContext) {
+	start := time.Now()
 	labels := make(map[string]labelType)
 
-	pods, err := kc.listPods()
+	round := ctx.currentRound()
+	kc.served = round.id
+	collectCtx, cancel := ctx.collectContext(round)
+	defer cancel()
+
+	pods, err := kc.listPods(collectCtx)
 	if err != nil {
 		logger.IluvatarLog.Errorln(err)
+		if status.Code(err) == codes.DeadlineExceeded {
+			kc.metrics.collectTimeouts.WithLabelValues(CollectorKubernetes).Inc()
+		}
 	} else {
-		gpuPods := kc.filterGpuPods(pods, kc.gpus.gpus)
+		gpuPods := kc.filterGpuPods(pods, kc.inventory.get())
 		for uuid, pod := range gpuPods {
-			podInfo, err := kc.clientset.CoreV1().Pods(pod.namespace).Get(context.TODO(), pod.name, v1.GetOptions{})
+			podInfo, err := kc.clientset.CoreV1().Pods(pod.namespace).Get(collectCtx, pod.name, v1.GetOptions{})
 			if err != nil {
 				logger.IluvatarLog.Errorf("Failed to get pod %v", err)
 			}
@@ -126,12 +148,19 @@ func (kc *kubeCollector) collectMetrics(ctx *ixContext) {
 	}
 
 	ctx.updateMetrics(labels)
+	kc.metrics.observeCollect(CollectorKubernetes, start, err == nil)
 }
 
-func (kc *kubeCollector) specificSplitBoard() error {
-	reader, err := os.Open(ConfigFile)
+// loadClusterConfig reads the split board flag of the cluster config, the flag is
+// false if there is no cluster config.
+func loadClusterConfig(path string) (bool, error) {
+	reader, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		logger.IluvatarLog.Infof("Cluster config '%s' not found, split board disabled", path)
+		return false, nil
+	}
 	if err != nil {
-		return err
+		return false, err
 	}
 
 	defer reader.Close()
@@ -139,35 +168,31 @@ func (kc *kubeCollector) specificSplitBoard() error {
 	clusterConfig, err := config.ParseConfigFrom(reader)
 	if err != nil {
 		logger.IluvatarLog.Errorf("error parsing config file: %v", err)
-		return err
+		return false, fmt.Errorf("invalid cluster config '%s': %v", path, err)
 	}
 
-	kc.SplitBoard = clusterConfig.Flags.SplitBoard
-	return nil
+	return clusterConfig.Flags.SplitBoard, nil
 }
 
-func (kc *kubeCollector) filterGpuPods(pods *podresourcesapi.ListPodResourcesResponse, gpus map[string]gpuInfo) map[string]gpuPod {
+func (kc *kubeCollector) filterGpuPods(pods *podresourcesapi.ListPodResourcesResponse, gpus iluvatarGPU) map[string]gpuPod {
 	gpuPods := make(map[string]gpuPod)
 
-	if err := kc.specificSplitBoard(); err != nil {
-		logger.IluvatarLog.Errorf("Failed to get split board %v", err)
-	}
-
-	logger.IluvatarLog.Infoln("get split board", kc.SplitBoard)
+	splitBoard := kc.config.get().splitBoard
+	logger.IluvatarLog.Infoln("get split board", splitBoard)
 
 	for _, pod := range pods.GetPodResources() {
 		for _, container := range pod.GetContainers() {
 			for _, device := range container.GetDevices() {
 				resourceName := device.GetResourceName()
-				if resourceName != iluvatarResourceName {
+				if resourceName != kc.resourceName {
 					continue
 				}
 				var gpusUuid []string
 
 				for _, uuid := range device.GetDeviceIds() {
 					uuidTmp := config.RemoveDeviceIduffix(uuid)
-					if !kc.SplitBoard {
-						if uuid_slary, ok := kc.gpus.pairChips[uuidTmp]; ok {
+					if !splitBoard {
+						if uuid_slary, ok := gpus.pairChips[uuidTmp]; ok {
 							if uuid_slary != uuidTmp {
 								gpusUuid = append(gpusUuid, uuidTmp)
 								gpusUuid = append(gpusUuid, uuid_slary)
@@ -221,10 +246,10 @@ func (kc *kubeCollector) connectToKubelet(socket string) (*grpc.ClientConn, erro
 	return conn, nil
 }
 
-func (kc *kubeCollector) listPods() (*podresourcesapi.ListPodResourcesResponse, error) {
+func (kc *kubeCollector) listPods(ctx context.Context) (*podresourcesapi.ListPodResourcesResponse, error) {
 	client := podresourcesapi.NewPodResourcesListerClient(kc.conn)
 
-	ctx, cancel := context.WithTimeout(context.Background(), kc.timeout)
+	ctx, cancel := context.WithTimeout(ctx, kc.timeout)
 	defer cancel()
 
 	resp, err := client.List(ctx, &podresourcesapi.ListPodResourcesRequest{})
@@ -236,15 +261,18 @@ func (kc *kubeCollector) listPods() (*podresourcesapi.ListPodResourcesResponse,
 	return resp, nil
 }
 
-func registerKubeCollector(ctx *ixContext, gpuInfo iluvatarGPU) {
+func registerKubeCollector(ctx *ixContext, config *configStore, inventory *gpuInventory, metrics *exporterMetrics,
+	opts *Options) {
 	var collector subCollector
 
 	collector = &kubeCollector{
-		gpus:    gpuInfo,
-		conn:    nil,
-		timeout: 10 * time.Second,
+		config:       config,
+		inventory:    inventory,
+		metrics:      metrics,
+		conn:         nil,
+		socket:       opts.KubeletSocket,
+		resourceName: opts.ResourceName,
+		timeout:      opts.KubeTimeout,
 	}
 	ctx.registerCollector(collector)
-
-	go collector.collect(ctx)
 }
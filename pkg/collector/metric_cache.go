@@ -0,0 +1,104 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricCache keeps the last read of the metrics configured with an interval, so
+// that a slow changing metric is only read again from the device when stale. A
+// metric read on enumeration is kept until its device vanishes or moves to another
+// index.
+type metricCache struct {
+	mutex   sync.Mutex
+	entries map[string]cachedMetrics
+}
+
+type cachedMetrics struct {
+	metrics []metric
+	// expires is zero for a metric read on enumeration.
+	expires time.Time
+}
+
+func newMetricCache() *metricCache {
+	return &metricCache{entries: make(map[string]cachedMetrics)}
+}
+
+// get returns copies of the cached metrics of the device, it reports false if
+// they are missing or stale.
+func (mc *metricCache) get(uuid, name string) ([]metric, bool) {
+	mc.mutex.Lock()
+	entry, ok := mc.entries[uuid+"/"+name]
+	mc.mutex.Unlock()
+
+	if !ok || (!entry.expires.IsZero() && time.Now().After(entry.expires)) {
+		return nil, false
+	}
+	return copyMetrics(entry.metrics), true
+}
+
+// set caches copies of the metrics read from the device, unless the metric is read
+// at every collection.
+func (mc *metricCache) set(uuid string, config collectorConfig, metrics []metric) {
+	if config.Interval == 0 && !config.OnEnumeration {
+		return
+	}
+
+	entry := cachedMetrics{metrics: copyMetrics(metrics)}
+	if !config.OnEnumeration {
+		entry.expires = time.Now().Add(config.Interval)
+	}
+
+	mc.mutex.Lock()
+	mc.entries[uuid+"/"+config.Name] = entry
+	mc.mutex.Unlock()
+}
+
+// forget drops the cached metrics of the device.
+func (mc *metricCache) forget(uuid string) {
+	mc.mutex.Lock()
+	for key := range mc.entries {
+		if strings.HasPrefix(key, uuid+"/") {
+			delete(mc.entries, key)
+		}
+	}
+	mc.mutex.Unlock()
+}
+
+func (mc *metricCache) reset() {
+	mc.mutex.Lock()
+	mc.entries = make(map[string]cachedMetrics)
+	mc.mutex.Unlock()
+}
+
+// copyMetrics copies the labels of the metrics too, since the labels of the stored
+// metrics are completed by updateMetrics.
+func copyMetrics(metrics []metric) []metric {
+	copied := make([]metric, len(metrics))
+	for i, m := range metrics {
+		labels := make(map[string]string, len(m.labels))
+		for k, v := range m.labels {
+			labels[k] = v
+		}
+		copied[i] = metric{name: m.name, labels: labels, value: m.value}
+	}
+	return copied
+}
@@ -0,0 +1,177 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	namespaceRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRE = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	helpUnitRE  = regexp.MustCompile(`\s*\([^()]*\)(\.?)$`)
+)
+
+// conventionalMetric is the name of a gpu metric in the conventional naming, whose
+// values are converted to base units by the scale.
+type conventionalMetric struct {
+	name    string
+	scale   float64
+	counter bool
+}
+
+// conventionalMetrics are the gpu metrics whose name or unit differ from the
+// Prometheus conventions, the others have the same name in every naming.
+var conventionalMetrics = map[string]conventionalMetric{
+	Temperature:              {name: "ix_temperature_celsius", scale: 1},
+	FanSpeed:                 {name: "ix_fan_speed_ratio", scale: 0.01},
+	SmClock:                  {name: "ix_sm_clock_hertz", scale: 1e6},
+	MemClock:                 {name: "ix_memory_clock_hertz", scale: 1e6},
+	MemTotal:                 {name: "ix_memory_total_bytes", scale: 1 << 20},
+	MemUsed:                  {name: "ix_memory_used_bytes", scale: 1 << 20},
+	MemFree:                  {name: "ix_memory_free_bytes", scale: 1 << 20},
+	MemUtilization:           {name: "ix_memory_utilization_ratio", scale: 0.01},
+	GpuUtilization:           {name: "ix_gpu_utilization_ratio", scale: 0.01},
+	PowerUsage:               {name: "ix_power_usage_watts", scale: 1},
+	ProcessInfo:              {name: "ix_process_memory_used_bytes", scale: 1 << 20},
+	XidErrors:                {name: "ix_xid_last_code", scale: 1},
+	SmUtilization:            {name: "ix_sm_utilization_ratio", scale: 0.01},
+	GpmGraphicsUtilization:   {name: "ix_gpm_graphics_utilization_ratio", scale: 0.01},
+	GpmSmOccupancy:           {name: "ix_gpm_sm_occupancy_ratio", scale: 0.01},
+	GpmIntegerUtilization:    {name: "ix_gpm_integer_utilization_ratio", scale: 0.01},
+	GpmTensorUtilization:     {name: "ix_gpm_tensor_utilization_ratio", scale: 0.01},
+	GpmDfmaTensorUtilization: {name: "ix_gpm_dfma_tensor_utilization_ratio", scale: 0.01},
+	GpmHmmaTensorUtilization: {name: "ix_gpm_hmma_tensor_utilization_ratio", scale: 0.01},
+	GpmImmaTensorUtilization: {name: "ix_gpm_imma_tensor_utilization_ratio", scale: 0.01},
+	GpmDramBwUtilization:     {name: "ix_gpm_dram_bandwidth_utilization_ratio", scale: 0.01},
+	GpmFp64Utilization:       {name: "ix_gpm_fp64_utilization_ratio", scale: 0.01},
+	GpmFp32Utilization:       {name: "ix_gpm_fp32_utilization_ratio", scale: 0.01},
+	GpmFp16Utilization:       {name: "ix_gpm_fp16_utilization_ratio", scale: 0.01},
+	GpmPcieTxBandwidth:       {name: "ix_gpm_pcie_tx_bandwidth_bytes_per_second", scale: 1 << 20},
+	GpmPcieRxBandwidth:       {name: "ix_gpm_pcie_rx_bandwidth_bytes_per_second", scale: 1 << 20},
+	GpmLinkTxBandwidth:       {name: "ix_gpm_link_tx_bandwidth_bytes_per_second", scale: 1 << 20},
+	GpmLinkRxBandwidth:       {name: "ix_gpm_link_rx_bandwidth_bytes_per_second", scale: 1 << 20},
+	PcieTxThroughput:         {name: "ix_pcie_tx_throughput_bytes_per_second", scale: 1 << 10},
+	PcieRxThroughput:         {name: "ix_pcie_rx_throughput_bytes_per_second", scale: 1 << 10},
+	PcieReplayCount:          {name: "ix_pcie_replays_total", scale: 1, counter: true},
+}
+
+// metricNaming builds the names and the constant labels of the exported metrics
+// from the metric naming, the metric namespace and the constant labels of the
+// options.
+type metricNaming struct {
+	mode        string
+	namespace   string
+	constLabels prometheus.Labels
+}
+
+func newMetricNaming(opts *Options) (*metricNaming, error) {
+	mode := opts.MetricNaming
+	switch mode {
+	case "":
+		mode = NamingLegacy
+	case NamingLegacy, NamingConventional, NamingCompat:
+	default:
+		return nil, fmt.Errorf("invalid metric naming '%s', expect '%s', '%s' or '%s'",
+			mode, NamingLegacy, NamingConventional, NamingCompat)
+	}
+
+	namespace := opts.MetricNamespace
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	if !namespaceRE.MatchString(namespace) {
+		return nil, fmt.Errorf("invalid metric namespace '%s'", namespace)
+	}
+
+	constLabels, err := parseConstLabels(opts.ConstLabels)
+	if err != nil {
+		return nil, err
+	}
+	return &metricNaming{mode: mode, namespace: namespace, constLabels: constLabels}, nil
+}
+
+// parseConstLabels parses constant labels of the form "name=value,name=value".
+func parseConstLabels(s string) (prometheus.Labels, error) {
+	labels := prometheus.Labels{}
+	if strings.TrimSpace(s) == "" {
+		return labels, nil
+	}
+
+	for _, pair := range strings.Split(s, ",") {
+		name, value, ok := strings.Cut(strings.TrimSpace(pair), "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid constant label '%s', expect name=value", pair)
+		}
+		if !labelNameRE.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("invalid constant label name '%s'", name)
+		}
+		if _, ok := labels[name]; ok {
+			return nil, fmt.Errorf("duplicate constant label '%s'", name)
+		}
+		labels[name] = value
+	}
+	return labels, nil
+}
+
+// name returns the exported name of the metric, the DefaultNamespace of a name is
+// replaced by the namespace.
+func (n *metricNaming) name(name string) string {
+	if rest, ok := strings.CutPrefix(name, DefaultNamespace+"_"); ok {
+		return n.namespace + "_" + rest
+	}
+	return name
+}
+
+// legacy reports whether the gpu metrics are exported with their legacy name.
+func (n *metricNaming) legacy() bool {
+	return n.mode != NamingConventional
+}
+
+// conventional reports whether the gpu metrics are exported with their
+// conventional name.
+func (n *metricNaming) conventional() bool {
+	return n.mode != NamingLegacy
+}
+
+// conventionalHelp drops the unit at the end of the help of a metric, since the
+// conventional name carries the base unit.
+func conventionalHelp(help string) string {
+	return helpUnitRE.ReplaceAllString(help, "$1")
+}
+
+// labels returns the constant labels merged with the constant labels of a metric,
+// which take precedence.
+func (n *metricNaming) labels(metricLabels map[string]string) prometheus.Labels {
+	if len(metricLabels) == 0 {
+		return n.constLabels
+	}
+
+	labels := make(prometheus.Labels, len(n.constLabels)+len(metricLabels))
+	for name, value := range n.constLabels {
+		labels[name] = value
+	}
+	for name, value := range metricLabels {
+		labels[name] = value
+	}
+	return labels
+}
@@ -0,0 +1,257 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestParseConstLabels(t *testing.T) {
+	tests := []struct {
+		labels string
+		want   prometheus.Labels
+		err    string
+	}{
+		{labels: "", want: prometheus.Labels{}},
+		{labels: "  ", want: prometheus.Labels{}},
+		{labels: "cluster=prod", want: prometheus.Labels{"cluster": "prod"}},
+		{labels: "cluster=prod, region=east ,empty=", want: prometheus.Labels{"cluster": "prod", "region": "east", "empty": ""}},
+		{labels: "cluster=a=b", want: prometheus.Labels{"cluster": "a=b"}},
+		{labels: "cluster", err: "invalid constant label 'cluster', expect name=value"},
+		{labels: "cluster=prod,", err: "invalid constant label '', expect name=value"},
+		{labels: "=prod", err: "invalid constant label name ''"},
+		{labels: "1cluster=prod", err: "invalid constant label name '1cluster'"},
+		{labels: "clu-ster=prod", err: "invalid constant label name 'clu-ster'"},
+		{labels: "region =east", err: "invalid constant label name 'region '"},
+		{labels: "__name__=prod", err: "invalid constant label name '__name__'"},
+		{labels: "__cluster=prod", err: "invalid constant label name '__cluster'"},
+		{labels: "cluster=prod,cluster=test", err: "duplicate constant label 'cluster'"},
+	}
+
+	for _, tt := range tests {
+		labels, err := parseConstLabels(tt.labels)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%q: got error %v, want %s", tt.labels, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tt.labels, err)
+			continue
+		}
+		if !reflect.DeepEqual(labels, tt.want) {
+			t.Errorf("%q: got %v, want %v", tt.labels, labels, tt.want)
+		}
+	}
+}
+
+func TestNewMetricNaming(t *testing.T) {
+	tests := []struct {
+		name string
+		opts Options
+		// names are the exported names of ix_temperature and ix_exporter_build_info.
+		names        [2]string
+		legacy, conv bool
+		err          string
+	}{
+		{name: "default", names: [2]string{"ix_temperature", "ix_exporter_build_info"}, legacy: true},
+		{name: "legacy", opts: Options{MetricNaming: NamingLegacy}, names: [2]string{"ix_temperature", "ix_exporter_build_info"},
+			legacy: true},
+		{name: "conventional", opts: Options{MetricNaming: NamingConventional},
+			names: [2]string{"ix_temperature", "ix_exporter_build_info"}, conv: true},
+		{name: "compat", opts: Options{MetricNaming: NamingCompat}, names: [2]string{"ix_temperature", "ix_exporter_build_info"},
+			legacy: true, conv: true},
+		{name: "namespace", opts: Options{MetricNamespace: "gpu"}, names: [2]string{"gpu_temperature", "gpu_exporter_build_info"},
+			legacy: true},
+		{name: "namespace with colon", opts: Options{MetricNamespace: "dc:gpu"},
+			names: [2]string{"dc:gpu_temperature", "dc:gpu_exporter_build_info"}, legacy: true},
+		{name: "invalid naming", opts: Options{MetricNaming: "camel"},
+			err: "invalid metric naming 'camel', expect 'legacy', 'conventional' or 'compat'"},
+		{name: "namespace with digit first", opts: Options{MetricNamespace: "1gpu"}, err: "invalid metric namespace '1gpu'"},
+		{name: "namespace with dash", opts: Options{MetricNamespace: "my-gpu"}, err: "invalid metric namespace 'my-gpu'"},
+		{name: "namespace with space", opts: Options{MetricNamespace: "gpu "}, err: "invalid metric namespace 'gpu '"},
+		{name: "invalid labels", opts: Options{ConstLabels: "__name__=x"}, err: "invalid constant label name '__name__'"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			naming, err := newMetricNaming(&tt.opts)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("got error %v, want %s", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := [2]string{naming.name(Temperature), naming.name(BuildInfo)}; got != tt.names {
+				t.Errorf("got names %v, want %v", got, tt.names)
+			}
+			if naming.legacy() != tt.legacy || naming.conventional() != tt.conv {
+				t.Errorf("got legacy %v and conventional %v, want %v and %v", naming.legacy(),
+					naming.conventional(), tt.legacy, tt.conv)
+			}
+		})
+	}
+}
+
+func TestMetricNamingLabels(t *testing.T) {
+	naming, err := newMetricNaming(&Options{ConstLabels: "cluster=prod,site=lab"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if labels := naming.labels(nil); !reflect.DeepEqual(labels, prometheus.Labels{"cluster": "prod", "site": "lab"}) {
+		t.Errorf("without metric labels: got %v", labels)
+	}
+
+	// The labels of a metric override the constant labels of the same name, the
+	// constant labels are not modified.
+	labels := naming.labels(map[string]string{"site": "rack1", "tier": "gold"})
+	if want := (prometheus.Labels{"cluster": "prod", "site": "rack1", "tier": "gold"}); !reflect.DeepEqual(labels, want) {
+		t.Errorf("with metric labels: got %v, want %v", labels, want)
+	}
+	if naming.constLabels["site"] != "lab" {
+		t.Errorf("constant labels modified: %v", naming.constLabels)
+	}
+}
+
+// TestConstLabelsExported checks the constant labels of the exported metrics, the
+// labels of a metric in the metrics config override them. A constant label taken by
+// a label of the exporter is rejected.
+func TestConstLabelsExported(t *testing.T) {
+	metricsConfig := filepath.Join(t.TempDir(), "metrics.yaml")
+	err := os.WriteFile(metricsConfig, []byte(`iluvatar:
+  metrics:
+  - name: ix_temperature
+    help: The temperature of the iluvatar GPU(C).
+    labels: {site: rack1}
+  - name: ix_power_usage
+    help: The power usage of iluvatar GPU.
+`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ic := newTestCollector(t, &Options{MetricsConfig: metricsConfig, MetricNamespace: "gpu",
+		ConstLabels: "cluster=prod,site=lab"})
+	metrics := scrapeDevices(t, ic)
+	for _, want := range []string{
+		`gpu_temperature{cluster="prod",gpu="0",name="Iluvatar BI-V150",site="rack1",uuid="GPU-00000000-0000-0000-0000-000000000000"} 31`,
+		`gpu_power_usage{cluster="prod",gpu="0",name="Iluvatar BI-V150",site="lab",uuid="GPU-00000000-0000-0000-0000-000000000000"} 13`,
+		`gpu_gpu_present{cluster="prod",gpu="0",name="Iluvatar BI-V150",site="lab",uuid="GPU-00000000-0000-0000-0000-000000000000"} 1`,
+	} {
+		if !strings.Contains(metrics, want+"\n") {
+			t.Errorf("%s not found in:\n%s", want, metrics)
+		}
+	}
+
+	for _, labels := range []string{"gpu=0", "uuid=x", "pod=x"} {
+		err = ValidateConfig(&Options{MetricsConfig: metricsConfig, ConstLabels: labels}, prometheus.NewRegistry())
+		if err == nil {
+			t.Errorf("constant label %s taken by the exporter accepted", labels)
+		}
+	}
+}
+
+func TestConventionalHelp(t *testing.T) {
+	tests := []struct {
+		help, want string
+	}{
+		{"Sm clock of iluvatar GPU (MHz).", "Sm clock of iluvatar GPU."},
+		{"The used physical memory of iluvatar GPU (MiB)", "The used physical memory of iluvatar GPU"},
+		{"The temperature of the iluvatar GPU(C).", "The temperature of the iluvatar GPU."},
+		{"The utilization of iluvatar GPU (%).", "The utilization of iluvatar GPU."},
+		// Only the unit at the end is dropped.
+		{"The (estimated) power usage of iluvatar GPU.", "The (estimated) power usage of iluvatar GPU."},
+		{"The power (W) usage of iluvatar GPU (W).", "The power (W) usage of iluvatar GPU."},
+		{"The fan speed (%) of iluvatar GPU", "The fan speed (%) of iluvatar GPU"},
+		{"The ratio (a (b)).", "The ratio (a (b))."},
+		{"The power usage of iluvatar GPU.", "The power usage of iluvatar GPU."},
+		{"", ""},
+	}
+
+	for _, tt := range tests {
+		if got := conventionalHelp(tt.help); got != tt.want {
+			t.Errorf("conventionalHelp(%q) = %q, want %q", tt.help, got, tt.want)
+		}
+	}
+}
+
+// TestNamingGolden compares the metrics of the second collection of the simulated
+// GPUs, the first one with the GPM metrics, with the golden file of each metric
+// naming.
+func TestNamingGolden(t *testing.T) {
+	for _, naming := range []string{NamingLegacy, NamingConventional, NamingCompat} {
+		t.Run(naming, func(t *testing.T) {
+			ic := newTestCollector(t, &Options{MetricNaming: naming})
+			scrapeDevices(t, ic)
+			checkGolden(t, "naming_"+naming+".prom", scrapeDevices(t, ic))
+		})
+	}
+}
+
+// TestConventionalScale checks the conversion of the values to base units in the
+// conventional naming, and that the compat naming exports both names.
+func TestConventionalScale(t *testing.T) {
+	const labels = `{gpu="1",name="Iluvatar BI-V150",uuid="GPU-11111111-1111-1111-1111-111111111111"}`
+	legacy := []string{
+		"ix_fan_speed" + labels + " 60",
+		"ix_sm_clock" + labels + " 1500",
+		"ix_mem_used" + labels + " 116",
+		"ix_temperature" + labels + " 33",
+	}
+	conventional := []string{
+		"ix_fan_speed_ratio" + labels + " 0.6",
+		"ix_sm_clock_hertz" + labels + " 1.5e+09",
+		"ix_memory_used_bytes" + labels + " 1.21634816e+08",
+		"ix_temperature_celsius" + labels + " 33",
+	}
+
+	tests := []struct {
+		naming        string
+		found, absent []string
+	}{
+		{NamingLegacy, legacy, conventional},
+		{NamingConventional, conventional, legacy},
+		{NamingCompat, append(append([]string(nil), legacy...), conventional...), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.naming, func(t *testing.T) {
+			metrics := scrapeDevices(t, newTestCollector(t, &Options{MetricNaming: tt.naming}))
+			for _, series := range tt.found {
+				if !strings.Contains(metrics, "\n"+series+"\n") {
+					t.Errorf("%s not found", series)
+				}
+			}
+			for _, series := range tt.absent {
+				if strings.Contains(metrics, "\n"+series+"\n") {
+					t.Errorf("%s found", series)
+				}
+			}
+		})
+	}
+}
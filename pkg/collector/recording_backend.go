@@ -0,0 +1,489 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"gitee.com/deep-spark/go-ixml/pkg/ixml"
+	"gitee.com/deep-spark/ixexporter/pkg/config"
+	"gitee.com/deep-spark/ixexporter/pkg/logger"
+)
+
+// Record runs the device enumeration and the given number of gpu collection
+// cycles, then writes every IXML query made into fixtureFile, which can be
+// served later by the '--replay' mode.
+func Record(opts *Options, fixtureFile string, cycles int, interval time.Duration) error {
+	if err := checkOptions(opts); err != nil {
+		return err
+	}
+
+	active, err := loadMetricsConfig(opts, LabelList)
+	if err != nil {
+		return err
+	}
+	naming, err := newMetricNaming(opts)
+	if err != nil {
+		return err
+	}
+
+	backend, err := newDeviceBackend(opts)
+	if err != nil {
+		return err
+	}
+	recorder := newRecordingBackend(backend)
+
+	gpus, err := getDeviceInfo(recorder)
+	if err != nil {
+		return err
+	}
+
+	gc := newGpuCollector(newConfigStore(active), newGpuInventory(gpus), recorder, newExporterMetrics(naming), newXidLog(), opts)
+	gc.initDevices()
+
+	ctx := newContext()
+	defer ctx.cancel()
+	for i := 0; i < cycles; i++ {
+		if i > 0 {
+			time.Sleep(interval)
+		}
+		logger.IluvatarLog.Infof("Record collection cycle %d/%d", i+1, cycles)
+		ctx.startRound(time.Time{})
+		gc.collectMetrics(ctx)
+	}
+
+	// IXML is shut down before the fixture is written, so that it holds the call.
+	if ret := recorder.Shutdown(); ret != ixml.SUCCESS {
+		logger.IluvatarLog.Warningf("Unable to shutdown IXML: %v", ret)
+	}
+
+	writer, err := os.Create(fixtureFile)
+	if err != nil {
+		return err
+	}
+	defer writer.Close()
+
+	return recorder.fixture().Save(writer)
+}
+
+// recordingBackend forwards every call to the wrapped backend and keeps a
+// record of the inputs, results and duration of the call.
+type recordingBackend struct {
+	backend deviceBackend
+	mutex   sync.Mutex
+	calls   []config.FixtureCall
+	devices map[string]*recordingDevice
+}
+
+func newRecordingBackend(backend deviceBackend) *recordingBackend {
+	return &recordingBackend{
+		backend: backend,
+		devices: make(map[string]*recordingDevice),
+	}
+}
+
+func (rb *recordingBackend) record(call config.FixtureCall, ret ixml.Return, start time.Time) {
+	call.Ret = returnCodeName(ret)
+	call.DurationNs = time.Since(start).Nanoseconds()
+
+	rb.mutex.Lock()
+	rb.calls = append(rb.calls, call)
+	rb.mutex.Unlock()
+}
+
+func (rb *recordingBackend) fixture() *config.Fixture {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	return &config.Fixture{
+		Version: config.FixtureVersion,
+		Calls:   append([]config.FixtureCall(nil), rb.calls...),
+	}
+}
+
+// wrap returns the recording device of the given handle. The uuid identifies the
+// device in the fixture, it is read without being recorded.
+func (rb *recordingBackend) wrap(device gpuDevice) *recordingDevice {
+	uuid, _ := device.GetUUID()
+
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	if rd, ok := rb.devices[uuid]; ok {
+		return rd
+	}
+	rd := &recordingDevice{device: device, uuid: uuid, rb: rb}
+	rb.devices[uuid] = rd
+	return rd
+}
+
+func (rb *recordingBackend) Init() ixml.Return {
+	start := time.Now()
+	ret := rb.backend.Init()
+	rb.record(config.FixtureCall{Query: "Init"}, ret, start)
+	return ret
+}
+
+func (rb *recordingBackend) Shutdown() ixml.Return {
+	start := time.Now()
+	ret := rb.backend.Shutdown()
+	rb.record(config.FixtureCall{Query: "Shutdown"}, ret, start)
+	return ret
+}
+
+func (rb *recordingBackend) DeviceGetCount() (uint, ixml.Return) {
+	start := time.Now()
+	count, ret := rb.backend.DeviceGetCount()
+	rb.record(config.FixtureCall{Query: "DeviceGetCount", Value: float64(count)}, ret, start)
+	return count, ret
+}
+
+func (rb *recordingBackend) SystemGetDriverVersion() (string, ixml.Return) {
+	start := time.Now()
+	version, ret := rb.backend.SystemGetDriverVersion()
+	rb.record(config.FixtureCall{Query: "SystemGetDriverVersion", Text: version}, ret, start)
+	return version, ret
+}
+
+func (rb *recordingBackend) SystemGetCudaDriverVersion() (string, ixml.Return) {
+	start := time.Now()
+	version, ret := rb.backend.SystemGetCudaDriverVersion()
+	rb.record(config.FixtureCall{Query: "SystemGetCudaDriverVersion", Text: version}, ret, start)
+	return version, ret
+}
+
+func (rb *recordingBackend) SystemGetIXMLVersion() (string, ixml.Return) {
+	start := time.Now()
+	version, ret := rb.backend.SystemGetIXMLVersion()
+	rb.record(config.FixtureCall{Query: "SystemGetIXMLVersion", Text: version}, ret, start)
+	return version, ret
+}
+
+func (rb *recordingBackend) DeviceGetHandleByIndex(index uint) (gpuDevice, ixml.Return) {
+	start := time.Now()
+	device, ret := rb.backend.DeviceGetHandleByIndex(index)
+	call := config.FixtureCall{
+		Query: "DeviceGetHandleByIndex",
+		Args:  []string{strconv.FormatUint(uint64(index), 10)},
+	}
+	if ret != ixml.SUCCESS {
+		rb.record(call, ret, start)
+		return device, ret
+	}
+	rd := rb.wrap(device)
+	call.Text = rd.uuid
+	rb.record(call, ret, start)
+	return rd, ret
+}
+
+func (rb *recordingBackend) GetHandleByUUID(uuid string) (gpuDevice, ixml.Return) {
+	start := time.Now()
+	device, ret := rb.backend.GetHandleByUUID(uuid)
+	call := config.FixtureCall{
+		Query: "GetHandleByUUID",
+		Args:  []string{uuid},
+	}
+	if ret != ixml.SUCCESS {
+		rb.record(call, ret, start)
+		return device, ret
+	}
+	rd := rb.wrap(device)
+	call.Text = rd.uuid
+	rb.record(call, ret, start)
+	return rd, ret
+}
+
+func (rb *recordingBackend) GetOnSameBoard(first, second gpuDevice) (int, ixml.Return) {
+	rd1, ok1 := first.(*recordingDevice)
+	rd2, ok2 := second.(*recordingDevice)
+	if !ok1 || !ok2 {
+		return 0, ixml.ERROR_INVALID_ARGUMENT
+	}
+
+	start := time.Now()
+	onSameBoard, ret := rb.backend.GetOnSameBoard(rd1.device, rd2.device)
+	rb.record(config.FixtureCall{
+		Query: "GetOnSameBoard",
+		Args:  []string{rd1.uuid, rd2.uuid},
+		Value: float64(onSameBoard),
+	}, ret, start)
+	return onSameBoard, ret
+}
+
+func (rb *recordingBackend) EventSetCreate() (eventSet, ixml.Return) {
+	start := time.Now()
+	set, ret := rb.backend.EventSetCreate()
+	rb.record(config.FixtureCall{Query: "EventSetCreate"}, ret, start)
+	if ret != ixml.SUCCESS {
+		return nil, ret
+	}
+	return &recordingEventSet{set: set, rb: rb}, ret
+}
+
+// recordingEventSet records the registrations and the events raised, waits which
+// timed out are left out of the fixture.
+type recordingEventSet struct {
+	set eventSet
+	rb  *recordingBackend
+}
+
+func (s *recordingEventSet) Register(device gpuDevice) ixml.Return {
+	rd, ok := device.(*recordingDevice)
+	if !ok {
+		return ixml.ERROR_INVALID_ARGUMENT
+	}
+
+	start := time.Now()
+	ret := s.set.Register(rd.device)
+	s.rb.record(config.FixtureCall{Device: rd.uuid, Query: "EventSetRegister"}, ret, start)
+	return ret
+}
+
+func (s *recordingEventSet) Wait(timeout time.Duration) (xidEvent, ixml.Return) {
+	start := time.Now()
+	event, ret := s.set.Wait(timeout)
+	if ret != ixml.ERROR_TIMEOUT {
+		s.rb.record(config.FixtureCall{Query: "EventSetWait", Text: event.uuid, Value: float64(event.xid)}, ret, start)
+	}
+	return event, ret
+}
+
+func (s *recordingEventSet) Free() {
+	s.set.Free()
+}
+
+type recordingDevice struct {
+	device gpuDevice
+	uuid   string
+	rb     *recordingBackend
+}
+
+// beginCycle forwards the start of a collection cycle to the recorded device.
+func (d *recordingDevice) beginCycle() {
+	if cd, ok := d.device.(cycleDevice); ok {
+		cd.beginCycle()
+	}
+}
+
+func (d *recordingDevice) record(call config.FixtureCall, ret ixml.Return, start time.Time) {
+	call.Device = d.uuid
+	d.rb.record(call, ret, start)
+}
+
+func (d *recordingDevice) GetName() (string, ixml.Return) {
+	start := time.Now()
+	name, ret := d.device.GetName()
+	d.record(config.FixtureCall{Query: "GetName", Text: name}, ret, start)
+	return name, ret
+}
+
+func (d *recordingDevice) GetUUID() (string, ixml.Return) {
+	start := time.Now()
+	uuid, ret := d.device.GetUUID()
+	d.record(config.FixtureCall{Query: "GetUUID", Text: uuid}, ret, start)
+	return uuid, ret
+}
+
+func (d *recordingDevice) GetBoardPosition() (uint32, ixml.Return) {
+	start := time.Now()
+	pos, ret := d.device.GetBoardPosition()
+	d.record(config.FixtureCall{Query: "GetBoardPosition", Value: float64(pos)}, ret, start)
+	return pos, ret
+}
+
+func (d *recordingDevice) GetPciBusId() (string, ixml.Return) {
+	start := time.Now()
+	busId, ret := d.device.GetPciBusId()
+	d.record(config.FixtureCall{Query: "GetPciBusId", Text: busId}, ret, start)
+	return busId, ret
+}
+
+func (d *recordingDevice) GetSerial() (string, ixml.Return) {
+	start := time.Now()
+	serial, ret := d.device.GetSerial()
+	d.record(config.FixtureCall{Query: "GetSerial", Text: serial}, ret, start)
+	return serial, ret
+}
+
+func (d *recordingDevice) GetBoardPartNumber() (string, ixml.Return) {
+	start := time.Now()
+	partNumber, ret := d.device.GetBoardPartNumber()
+	d.record(config.FixtureCall{Query: "GetBoardPartNumber", Text: partNumber}, ret, start)
+	return partNumber, ret
+}
+
+func (d *recordingDevice) GetVbiosVersion() (string, ixml.Return) {
+	start := time.Now()
+	version, ret := d.device.GetVbiosVersion()
+	d.record(config.FixtureCall{Query: "GetVbiosVersion", Text: version}, ret, start)
+	return version, ret
+}
+
+func (d *recordingDevice) GetTemperature() (uint32, ixml.Return) {
+	start := time.Now()
+	temperature, ret := d.device.GetTemperature()
+	d.record(config.FixtureCall{Query: "GetTemperature", Value: float64(temperature)}, ret, start)
+	return temperature, ret
+}
+
+func (d *recordingDevice) GetFanSpeed() (uint32, ixml.Return) {
+	start := time.Now()
+	speed, ret := d.device.GetFanSpeed()
+	d.record(config.FixtureCall{Query: "GetFanSpeed", Value: float64(speed)}, ret, start)
+	return speed, ret
+}
+
+func (d *recordingDevice) GetClockInfo() (clockInfo, ixml.Return) {
+	start := time.Now()
+	clock, ret := d.device.GetClockInfo()
+	d.record(config.FixtureCall{
+		Query:  "GetClockInfo",
+		Fields: map[string]float64{"sm": float64(clock.sm), "mem": float64(clock.mem)},
+	}, ret, start)
+	return clock, ret
+}
+
+func (d *recordingDevice) GetMemoryInfo() (memoryInfo, ixml.Return) {
+	start := time.Now()
+	mem, ret := d.device.GetMemoryInfo()
+	d.record(config.FixtureCall{
+		Query:  "GetMemoryInfo",
+		Fields: map[string]float64{"total": float64(mem.total), "used": float64(mem.used), "free": float64(mem.free)},
+	}, ret, start)
+	return mem, ret
+}
+
+func (d *recordingDevice) GetPowerUsage() (uint32, ixml.Return) {
+	start := time.Now()
+	usage, ret := d.device.GetPowerUsage()
+	d.record(config.FixtureCall{Query: "GetPowerUsage", Value: float64(usage)}, ret, start)
+	return usage, ret
+}
+
+func (d *recordingDevice) GetUtilizationRates() (utilizationInfo, ixml.Return) {
+	start := time.Now()
+	utilization, ret := d.device.GetUtilizationRates()
+	d.record(config.FixtureCall{
+		Query:  "GetUtilizationRates",
+		Fields: map[string]float64{"gpu": float64(utilization.gpu), "memory": float64(utilization.memory)},
+	}, ret, start)
+	return utilization, ret
+}
+
+func (d *recordingDevice) GetComputeRunningProcesses() ([]processInfo, ixml.Return) {
+	start := time.Now()
+	infos, ret := d.device.GetComputeRunningProcesses()
+	processes := make([]config.ScenarioProcess, 0, len(infos))
+	for _, info := range infos {
+		processes = append(processes, config.ScenarioProcess{Pid: info.pid, UsedMemory: info.usedGpuMemory})
+	}
+	d.record(config.FixtureCall{Query: "GetComputeRunningProcesses", Processes: processes}, ret, start)
+	return infos, ret
+}
+
+func (d *recordingDevice) GetCurrentClocksThrottleReasons() (uint64, ixml.Return) {
+	start := time.Now()
+	reasons, ret := d.device.GetCurrentClocksThrottleReasons()
+	d.record(config.FixtureCall{Query: "GetCurrentClocksThrottleReasons", Value: float64(reasons)}, ret, start)
+	return reasons, ret
+}
+
+func (d *recordingDevice) GetViolationTime(policy violationPolicy) (uint64, ixml.Return) {
+	start := time.Now()
+	duration, ret := d.device.GetViolationTime(policy)
+	d.record(config.FixtureCall{
+		Query: "GetViolationTime",
+		Args:  []string{string(policy)},
+		Value: float64(duration),
+	}, ret, start)
+	return duration, ret
+}
+
+func (d *recordingDevice) GetPcieThroughput() (pcieThroughput, ixml.Return) {
+	start := time.Now()
+	throughput, ret := d.device.GetPcieThroughput()
+	d.record(config.FixtureCall{
+		Query:  "GetPcieThroughput",
+		Fields: map[string]float64{"tx": float64(throughput.tx), "rx": float64(throughput.rx)},
+	}, ret, start)
+	return throughput, ret
+}
+
+func (d *recordingDevice) GetPcieReplayCounter() (uint32, ixml.Return) {
+	start := time.Now()
+	count, ret := d.device.GetPcieReplayCounter()
+	d.record(config.FixtureCall{Query: "GetPcieReplayCounter", Value: float64(count)}, ret, start)
+	return count, ret
+}
+
+func (d *recordingDevice) GetPcieLinkInfo() (pcieLinkInfo, ixml.Return) {
+	start := time.Now()
+	link, ret := d.device.GetPcieLinkInfo()
+	d.record(config.FixtureCall{
+		Query: "GetPcieLinkInfo",
+		Fields: map[string]float64{
+			"currGen":   float64(link.currGeneration),
+			"maxGen":    float64(link.maxGeneration),
+			"currWidth": float64(link.currWidth),
+			"maxWidth":  float64(link.maxWidth),
+		},
+	}, ret, start)
+	return link, ret
+}
+
+func (d *recordingDevice) GetEccErros() (uint64, uint64, ixml.Return) {
+	start := time.Now()
+	singleErr, doubleErr, ret := d.device.GetEccErros()
+	d.record(config.FixtureCall{
+		Query:  "GetEccErros",
+		Fields: map[string]float64{"sbe": float64(singleErr), "dbe": float64(doubleErr)},
+	}, ret, start)
+	return singleErr, doubleErr, ret
+}
+
+func (d *recordingDevice) GpmQueryDeviceSupport() (bool, ixml.Return) {
+	start := time.Now()
+	supported, ret := d.device.GpmQueryDeviceSupport()
+	var value float64
+	if supported {
+		value = 1
+	}
+	d.record(config.FixtureCall{Query: "GpmQueryDeviceSupport", Value: value}, ret, start)
+	return supported, ret
+}
+
+func (d *recordingDevice) GpmSampleGet() (gpmSample, ixml.Return) {
+	start := time.Now()
+	sample, ret := d.device.GpmSampleGet()
+	d.record(config.FixtureCall{Query: "GpmSampleGet"}, ret, start)
+	return sample, ret
+}
+
+func (d *recordingDevice) GpmMetricGet(sample1, sample2 gpmSample, metricId uint32) (float64, ixml.Return) {
+	start := time.Now()
+	value, ret := d.device.GpmMetricGet(sample1, sample2, metricId)
+	d.record(config.FixtureCall{
+		Query: "GpmMetricGet",
+		Args:  []string{strconv.FormatUint(uint64(metricId), 10)},
+		Value: value,
+	}, ret, start)
+	return value, ret
+}
@@ -0,0 +1,144 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gitee.com/deep-spark/ixexporter/pkg/config"
+	"gitee.com/deep-spark/ixexporter/pkg/logger"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Reload loads the metrics config and the cluster config again, and swaps them in
+// for the next collections and scrapes if both are valid. The descriptors of the
+// gpu metrics are checked against the metrics of reg, as at start. The previous
+// configs are kept if the reload fails. The other settings of the exporter config
+// file are only applied at start, a change is logged.
+func (ic *iluvatarCollector) Reload(reg *prometheus.Registry) error {
+	ic.reloadMutex.Lock()
+	defer ic.reloadMutex.Unlock()
+
+	active, err := loadConfig(ic.opts, ic.labels, true)
+	if err == nil {
+		err = checkConfig(reg, ic.metrics, active)
+	}
+	if err == nil {
+		err = checkSettings(ic.opts)
+	}
+	if err != nil {
+		logger.IluvatarLog.Errorf("Failed to reload config, keep the previous one: %v", err)
+		ic.metrics.observeReload(false)
+		return err
+	}
+
+	ic.config.set(active)
+	ic.metrics.observeReload(true)
+	logger.IluvatarLog.Infof("Config reloaded, %d gpu metrics, split board %v",
+		len(active.collectorConfigs), active.splitBoard)
+	return nil
+}
+
+// WatchConfig reloads the configs whenever the content of the metrics config or
+// of the cluster config changes, the files are checked at every interval until
+// the context is done. A file is compared by content rather than modification
+// time, since a mounted ConfigMap is updated by swapping a symlink.
+func (ic *iluvatarCollector) WatchConfig(ctx context.Context, reg *prometheus.Registry, interval time.Duration) {
+	paths := []string{ic.opts.MetricsConfig}
+	if ic.opts.EnableKube {
+		paths = append(paths, ic.opts.ClusterConfig)
+	}
+	if ic.opts.ConfigFile != "" && ic.opts.ConfigFile != ic.opts.MetricsConfig {
+		paths = append(paths, ic.opts.ConfigFile)
+	}
+
+	digests := make(map[string][sha256.Size]byte)
+	for _, path := range paths {
+		digests[path] = fileDigest(path)
+	}
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				changed := false
+				for _, path := range paths {
+					digest := fileDigest(path)
+					if digest != digests[path] {
+						logger.IluvatarLog.Infof("Config '%s' changed", path)
+						digests[path] = digest
+						changed = true
+					}
+				}
+				if changed {
+					ic.Reload(reg)
+				}
+			}
+		}
+	}()
+}
+
+// checkSettings checks the exporter config file of the options, and logs the
+// settings it changed since start, which are not applied until a restart.
+func checkSettings(opts *Options) error {
+	if opts.ConfigFile == "" {
+		return nil
+	}
+
+	settings, err := config.ParseSettings(opts.ConfigFile, opts.SettingNames)
+	if err != nil {
+		return fmt.Errorf("invalid exporter config file '%s': %v", opts.ConfigFile, err)
+	}
+	values := make(map[string]string, len(settings.Values))
+	for _, setting := range settings.Values {
+		values[setting.Name] = setting.Value
+	}
+
+	var changed []string
+	for name, value := range opts.Settings {
+		if values[name] != value {
+			changed = append(changed, name)
+		}
+	}
+	if len(changed) > 0 {
+		sort.Strings(changed)
+		logger.IluvatarLog.Warningf("Settings %s of '%s' changed, restart the exporter to apply them",
+			strings.Join(changed, ", "), opts.ConfigFile)
+	}
+	return nil
+}
+
+// fileDigest returns the digest of the content of the file, the zero digest if it
+// can not be read.
+func fileDigest(path string) [sha256.Size]byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}
+	}
+	return sha256.Sum256(data)
+}
@@ -0,0 +1,381 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gitee.com/deep-spark/go-ixml/pkg/ixml"
+	"gitee.com/deep-spark/ixexporter/pkg/config"
+)
+
+// replayBackend serves the IXML responses recorded by 'ix-exporter record'. The
+// recorded calls of a query are returned in order, each taking as long as it did
+// when recorded, and the last one is repeated once exhausted.
+type replayBackend struct {
+	mutex   sync.Mutex
+	calls   map[string][]config.FixtureCall
+	served  map[string]int
+	devices map[string]*replayDevice
+}
+
+func newReplayBackend(fixtureFile string) (*replayBackend, error) {
+	reader, err := os.Open(fixtureFile)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	fixture, err := config.ParseFixtureFrom(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	rb := &replayBackend{
+		calls:   make(map[string][]config.FixtureCall),
+		served:  make(map[string]int),
+		devices: make(map[string]*replayDevice),
+	}
+	for i, call := range fixture.Calls {
+		if _, err = parseReturnCode(call.Ret); err != nil {
+			return nil, fmt.Errorf("call %d '%s': %v", i, call.Query, err)
+		}
+		key := replayKey(call.Device, call.Query, call.Args...)
+		rb.calls[key] = append(rb.calls[key], call)
+	}
+
+	return rb, nil
+}
+
+func replayKey(device, query string, args ...string) string {
+	return device + "/" + query + "/" + strings.Join(args, ",")
+}
+
+func (rb *replayBackend) next(device, query string, args ...string) (config.FixtureCall, ixml.Return) {
+	key := replayKey(device, query, args...)
+
+	rb.mutex.Lock()
+	calls, ok := rb.calls[key]
+	if !ok || len(calls) == 0 {
+		rb.mutex.Unlock()
+		return config.FixtureCall{}, ixml.ERROR_NOT_SUPPORTED
+	}
+	index := rb.served[key]
+	if index >= len(calls) {
+		index = len(calls) - 1
+	} else {
+		rb.served[key]++
+	}
+	rb.mutex.Unlock()
+
+	call := calls[index]
+	time.Sleep(time.Duration(call.DurationNs))
+
+	ret, _ := parseReturnCode(call.Ret)
+	return call, ret
+}
+
+// take is next for calls which must be served once, such as events and the
+// shutdown, it reports false once the recorded calls are exhausted.
+func (rb *replayBackend) take(device, query string, args ...string) (config.FixtureCall, bool) {
+	key := replayKey(device, query, args...)
+
+	rb.mutex.Lock()
+	calls := rb.calls[key]
+	index := rb.served[key]
+	if index >= len(calls) {
+		rb.mutex.Unlock()
+		return config.FixtureCall{}, false
+	}
+	rb.served[key]++
+	rb.mutex.Unlock()
+
+	return calls[index], true
+}
+
+func (rb *replayBackend) device(uuid string) *replayDevice {
+	rb.mutex.Lock()
+	defer rb.mutex.Unlock()
+
+	if device, ok := rb.devices[uuid]; ok {
+		return device
+	}
+	device := &replayDevice{uuid: uuid, rb: rb}
+	rb.devices[uuid] = device
+	return device
+}
+
+func (rb *replayBackend) Init() ixml.Return {
+	_, ret := rb.next("", "Init")
+	return ret
+}
+
+// Shutdown answers the recorded shutdown once, IXML is shut down again on exit
+// after a shutdown on enumeration failure.
+func (rb *replayBackend) Shutdown() ixml.Return {
+	call, ok := rb.take("", "Shutdown")
+	if !ok {
+		return ixml.SUCCESS
+	}
+	ret, _ := parseReturnCode(call.Ret)
+	return ret
+}
+
+func (rb *replayBackend) DeviceGetCount() (uint, ixml.Return) {
+	call, ret := rb.next("", "DeviceGetCount")
+	return uint(call.Value), ret
+}
+
+func (rb *replayBackend) SystemGetDriverVersion() (string, ixml.Return) {
+	call, ret := rb.next("", "SystemGetDriverVersion")
+	return call.Text, ret
+}
+
+func (rb *replayBackend) SystemGetCudaDriverVersion() (string, ixml.Return) {
+	call, ret := rb.next("", "SystemGetCudaDriverVersion")
+	return call.Text, ret
+}
+
+func (rb *replayBackend) SystemGetIXMLVersion() (string, ixml.Return) {
+	call, ret := rb.next("", "SystemGetIXMLVersion")
+	return call.Text, ret
+}
+
+func (rb *replayBackend) DeviceGetHandleByIndex(index uint) (gpuDevice, ixml.Return) {
+	call, ret := rb.next("", "DeviceGetHandleByIndex", strconv.FormatUint(uint64(index), 10))
+	if ret != ixml.SUCCESS {
+		return nil, ret
+	}
+	return rb.device(call.Text), ret
+}
+
+func (rb *replayBackend) GetHandleByUUID(uuid string) (gpuDevice, ixml.Return) {
+	call, ret := rb.next("", "GetHandleByUUID", uuid)
+	if ret != ixml.SUCCESS {
+		return nil, ret
+	}
+	return rb.device(call.Text), ret
+}
+
+func (rb *replayBackend) GetOnSameBoard(first, second gpuDevice) (int, ixml.Return) {
+	d1, ok1 := first.(*replayDevice)
+	d2, ok2 := second.(*replayDevice)
+	if !ok1 || !ok2 {
+		return 0, ixml.ERROR_INVALID_ARGUMENT
+	}
+	call, ret := rb.next("", "GetOnSameBoard", d1.uuid, d2.uuid)
+	return int(call.Value), ret
+}
+
+func (rb *replayBackend) EventSetCreate() (eventSet, ixml.Return) {
+	_, ret := rb.next("", "EventSetCreate")
+	if ret != ixml.SUCCESS {
+		return nil, ret
+	}
+	return replayEventSet{rb: rb}, ret
+}
+
+// replayEventSet raises each recorded event once, in order, at the pace at which
+// they were recorded, then only times out.
+type replayEventSet struct {
+	rb *replayBackend
+}
+
+func (s replayEventSet) Register(device gpuDevice) ixml.Return {
+	d, ok := device.(*replayDevice)
+	if !ok {
+		return ixml.ERROR_INVALID_ARGUMENT
+	}
+	_, ret := d.next("EventSetRegister")
+	return ret
+}
+
+func (s replayEventSet) Wait(timeout time.Duration) (xidEvent, ixml.Return) {
+	call, ok := s.rb.take("", "EventSetWait")
+	if !ok {
+		time.Sleep(timeout)
+		return xidEvent{}, ixml.ERROR_TIMEOUT
+	}
+
+	time.Sleep(min(time.Duration(call.DurationNs), timeout))
+	ret, _ := parseReturnCode(call.Ret)
+	if ret != ixml.SUCCESS {
+		return xidEvent{}, ret
+	}
+	return xidEvent{uuid: call.Text, xid: uint64(call.Value), timestamp: time.Now()}, ret
+}
+
+func (s replayEventSet) Free() {}
+
+type replayDevice struct {
+	uuid string
+	rb   *replayBackend
+}
+
+func (d *replayDevice) next(query string, args ...string) (config.FixtureCall, ixml.Return) {
+	return d.rb.next(d.uuid, query, args...)
+}
+
+func (d *replayDevice) GetName() (string, ixml.Return) {
+	call, ret := d.next("GetName")
+	return call.Text, ret
+}
+
+func (d *replayDevice) GetUUID() (string, ixml.Return) {
+	call, ret := d.next("GetUUID")
+	return call.Text, ret
+}
+
+func (d *replayDevice) GetBoardPosition() (uint32, ixml.Return) {
+	call, ret := d.next("GetBoardPosition")
+	return uint32(call.Value), ret
+}
+
+func (d *replayDevice) GetPciBusId() (string, ixml.Return) {
+	call, ret := d.next("GetPciBusId")
+	return call.Text, ret
+}
+
+func (d *replayDevice) GetSerial() (string, ixml.Return) {
+	call, ret := d.next("GetSerial")
+	return call.Text, ret
+}
+
+func (d *replayDevice) GetBoardPartNumber() (string, ixml.Return) {
+	call, ret := d.next("GetBoardPartNumber")
+	return call.Text, ret
+}
+
+func (d *replayDevice) GetVbiosVersion() (string, ixml.Return) {
+	call, ret := d.next("GetVbiosVersion")
+	return call.Text, ret
+}
+
+func (d *replayDevice) GetTemperature() (uint32, ixml.Return) {
+	call, ret := d.next("GetTemperature")
+	return uint32(call.Value), ret
+}
+
+func (d *replayDevice) GetFanSpeed() (uint32, ixml.Return) {
+	call, ret := d.next("GetFanSpeed")
+	return uint32(call.Value), ret
+}
+
+func (d *replayDevice) GetClockInfo() (clockInfo, ixml.Return) {
+	call, ret := d.next("GetClockInfo")
+	return clockInfo{
+		sm:  uint32(call.Fields["sm"]),
+		mem: uint32(call.Fields["mem"]),
+	}, ret
+}
+
+func (d *replayDevice) GetMemoryInfo() (memoryInfo, ixml.Return) {
+	call, ret := d.next("GetMemoryInfo")
+	return memoryInfo{
+		total: uint64(call.Fields["total"]),
+		used:  uint64(call.Fields["used"]),
+		free:  uint64(call.Fields["free"]),
+	}, ret
+}
+
+func (d *replayDevice) GetPowerUsage() (uint32, ixml.Return) {
+	call, ret := d.next("GetPowerUsage")
+	return uint32(call.Value), ret
+}
+
+func (d *replayDevice) GetUtilizationRates() (utilizationInfo, ixml.Return) {
+	call, ret := d.next("GetUtilizationRates")
+	return utilizationInfo{
+		gpu:    uint32(call.Fields["gpu"]),
+		memory: uint32(call.Fields["memory"]),
+	}, ret
+}
+
+func (d *replayDevice) GetComputeRunningProcesses() ([]processInfo, ixml.Return) {
+	call, ret := d.next("GetComputeRunningProcesses")
+	infos := make([]processInfo, 0, len(call.Processes))
+	for _, process := range call.Processes {
+		infos = append(infos, processInfo{pid: process.Pid, usedGpuMemory: process.UsedMemory})
+	}
+	return infos, ret
+}
+
+func (d *replayDevice) GetCurrentClocksThrottleReasons() (uint64, ixml.Return) {
+	call, ret := d.next("GetCurrentClocksThrottleReasons")
+	return uint64(call.Value), ret
+}
+
+func (d *replayDevice) GetViolationTime(policy violationPolicy) (uint64, ixml.Return) {
+	call, ret := d.next("GetViolationTime", string(policy))
+	return uint64(call.Value), ret
+}
+
+func (d *replayDevice) GetPcieThroughput() (pcieThroughput, ixml.Return) {
+	call, ret := d.next("GetPcieThroughput")
+	return pcieThroughput{
+		tx: uint32(call.Fields["tx"]),
+		rx: uint32(call.Fields["rx"]),
+	}, ret
+}
+
+func (d *replayDevice) GetPcieReplayCounter() (uint32, ixml.Return) {
+	call, ret := d.next("GetPcieReplayCounter")
+	return uint32(call.Value), ret
+}
+
+func (d *replayDevice) GetPcieLinkInfo() (pcieLinkInfo, ixml.Return) {
+	call, ret := d.next("GetPcieLinkInfo")
+	return pcieLinkInfo{
+		currGeneration: uint32(call.Fields["currGen"]),
+		maxGeneration:  uint32(call.Fields["maxGen"]),
+		currWidth:      uint32(call.Fields["currWidth"]),
+		maxWidth:       uint32(call.Fields["maxWidth"]),
+	}, ret
+}
+
+func (d *replayDevice) GetEccErros() (uint64, uint64, ixml.Return) {
+	call, ret := d.next("GetEccErros")
+	return uint64(call.Fields["sbe"]), uint64(call.Fields["dbe"]), ret
+}
+
+func (d *replayDevice) GpmQueryDeviceSupport() (bool, ixml.Return) {
+	call, ret := d.next("GpmQueryDeviceSupport")
+	return call.Value != 0, ret
+}
+
+type replayGpmSample struct{}
+
+func (replayGpmSample) Free() {}
+
+func (d *replayDevice) GpmSampleGet() (gpmSample, ixml.Return) {
+	_, ret := d.next("GpmSampleGet")
+	if ret != ixml.SUCCESS {
+		return nil, ret
+	}
+	return replayGpmSample{}, ret
+}
+
+func (d *replayDevice) GpmMetricGet(_, _ gpmSample, metricId uint32) (float64, ixml.Return) {
+	call, ret := d.next("GpmMetricGet", strconv.FormatUint(uint64(metricId), 10))
+	return call.Value, ret
+}
@@ -0,0 +1,61 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gitee.com/deep-spark/ixexporter/pkg/config"
+)
+
+func TestReplayRoundTrip(t *testing.T) {
+	const cycles = 3
+	fixtureFile := filepath.Join(t.TempDir(), "fixture.yaml")
+	opts := &Options{
+		MetricsConfig:  filepath.Join("testdata", "metrics.yaml"),
+		SimulateConfig: filepath.Join("testdata", "scenario.yaml"),
+		CollectTimeout: time.Second,
+	}
+	if err := Record(opts, fixtureFile, cycles, 0); err != nil {
+		t.Fatalf("Record: %v", err)
+	}
+
+	reader, err := os.Open(fixtureFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer reader.Close()
+	fixture, err := config.ParseFixtureFrom(reader)
+	if err != nil {
+		t.Fatalf("ParseFixtureFrom: %v", err)
+	}
+	if last := fixture.Calls[len(fixture.Calls)-1]; last.Query != "Shutdown" {
+		t.Errorf("last recorded call %s, want Shutdown", last.Query)
+	}
+
+	simulated := collectCycles(t, &Options{}, cycles)
+	replayed := collectCycles(t, &Options{ReplayFile: fixtureFile}, cycles)
+	for i := range simulated {
+		if replayed[i] != simulated[i] {
+			t.Errorf("cycle %d: replayed metrics\n%s\nwant the simulated ones\n%s", i+1, replayed[i], simulated[i])
+		}
+	}
+}
@@ -0,0 +1,446 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"gitee.com/deep-spark/go-ixml/pkg/ixml"
+	"gitee.com/deep-spark/ixexporter/pkg/config"
+)
+
+// Query names used as keys of 'metrics' in a scenario file.
+const (
+	queryTemperature     = "temperature"
+	queryFanSpeed        = "fanSpeed"
+	queryClock           = "clock"
+	queryMemory          = "memory"
+	queryPowerUsage      = "powerUsage"
+	queryUtilization     = "utilization"
+	queryProcesses       = "processes"
+	queryThrottleReasons = "throttleReasons"
+	queryViolationTime   = "violationTime"
+	queryPcieThroughput  = "pcieThroughput"
+	queryPcieReplay      = "pcieReplay"
+	queryPcieLink        = "pcieLink"
+	queryEcc             = "ecc"
+	queryGpmSupport      = "gpmSupport"
+	queryGpm             = "gpm"
+	queryXid             = "xid"
+)
+
+var returnCodes = map[string]ixml.Return{
+	"":                        ixml.SUCCESS,
+	"SUCCESS":                 ixml.SUCCESS,
+	"ERROR_UNINITIALIZED":     ixml.ERROR_UNINITIALIZED,
+	"ERROR_INVALID_ARGUMENT":  ixml.ERROR_INVALID_ARGUMENT,
+	"ERROR_NOT_SUPPORTED":     ixml.ERROR_NOT_SUPPORTED,
+	"ERROR_NO_PERMISSION":     ixml.ERROR_NO_PERMISSION,
+	"ERROR_NOT_FOUND":         ixml.ERROR_NOT_FOUND,
+	"ERROR_DRIVER_NOT_LOADED": ixml.ERROR_DRIVER_NOT_LOADED,
+	"ERROR_TIMEOUT":           ixml.ERROR_TIMEOUT,
+	"ERROR_GPU_IS_LOST":       ixml.ERROR_GPU_IS_LOST,
+	"ERROR_UNKNOWN":           ixml.ERROR_UNKNOWN,
+}
+
+// parseReturnCode accepts the names of returnCodes, and the numeric value of any
+// other code as written by returnCodeName.
+func parseReturnCode(name string) (ixml.Return, error) {
+	if ret, ok := returnCodes[name]; ok {
+		return ret, nil
+	}
+	if code, err := strconv.ParseInt(name, 10, 32); err == nil {
+		return ixml.Return(code), nil
+	}
+	return ixml.ERROR_UNKNOWN, fmt.Errorf("unknown return code '%s'", name)
+}
+
+func returnCodeName(ret ixml.Return) string {
+	for name, code := range returnCodes {
+		if name != "" && code == ret {
+			return name
+		}
+	}
+	return fmt.Sprintf("%d", ret)
+}
+
+// simulatedBackend serves the devices described in a scenario file, so the
+// exporter can run without an Iluvatar GPU.
+type simulatedBackend struct {
+	scenario *config.Scenario
+	devices  []*simulatedDevice
+}
+
+func newSimulatedBackend(scenarioFile string) (*simulatedBackend, error) {
+	reader, err := os.Open(scenarioFile)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	scenario, err := config.ParseScenarioFrom(reader)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err = parseReturnCode(scenario.InitRet); err != nil {
+		return nil, err
+	}
+
+	sb := &simulatedBackend{scenario: scenario}
+	for i := range scenario.Devices {
+		for query, steps := range scenario.Devices[i].Metrics {
+			for _, step := range steps {
+				if _, err = parseReturnCode(step.Ret); err != nil {
+					return nil, fmt.Errorf("device '%s' query '%s': %v", scenario.Devices[i].UUID, query, err)
+				}
+			}
+		}
+		sb.devices = append(sb.devices, &simulatedDevice{config: &scenario.Devices[i]})
+	}
+
+	return sb, nil
+}
+
+func (sb *simulatedBackend) Init() ixml.Return {
+	ret, _ := parseReturnCode(sb.scenario.InitRet)
+	return ret
+}
+
+func (sb *simulatedBackend) Shutdown() ixml.Return {
+	return ixml.SUCCESS
+}
+
+func (sb *simulatedBackend) DeviceGetCount() (uint, ixml.Return) {
+	return uint(len(sb.devices)), ixml.SUCCESS
+}
+
+func (sb *simulatedBackend) SystemGetDriverVersion() (string, ixml.Return) {
+	return sb.scenario.DriverVersion, ixml.SUCCESS
+}
+
+func (sb *simulatedBackend) SystemGetCudaDriverVersion() (string, ixml.Return) {
+	return sb.scenario.CudaVersion, ixml.SUCCESS
+}
+
+func (sb *simulatedBackend) SystemGetIXMLVersion() (string, ixml.Return) {
+	return sb.scenario.IxmlVersion, ixml.SUCCESS
+}
+
+func (sb *simulatedBackend) DeviceGetHandleByIndex(index uint) (gpuDevice, ixml.Return) {
+	if index >= uint(len(sb.devices)) {
+		return nil, ixml.ERROR_INVALID_ARGUMENT
+	}
+	return sb.devices[index], ixml.SUCCESS
+}
+
+func (sb *simulatedBackend) GetHandleByUUID(uuid string) (gpuDevice, ixml.Return) {
+	for _, device := range sb.devices {
+		if device.config.UUID == uuid {
+			return device, ixml.SUCCESS
+		}
+	}
+	return nil, ixml.ERROR_NOT_FOUND
+}
+
+func (sb *simulatedBackend) GetOnSameBoard(first, second gpuDevice) (int, ixml.Return) {
+	d1, ok1 := first.(*simulatedDevice)
+	d2, ok2 := second.(*simulatedDevice)
+	if !ok1 || !ok2 {
+		return 0, ixml.ERROR_INVALID_ARGUMENT
+	}
+	if d1.config.BoardPosition == nil || d2.config.BoardPosition == nil {
+		return 0, ixml.ERROR_NOT_SUPPORTED
+	}
+	if d1.config.Pair == d2.config.UUID || d2.config.Pair == d1.config.UUID {
+		return 1, ixml.SUCCESS
+	}
+	return 0, ixml.SUCCESS
+}
+
+func (sb *simulatedBackend) EventSetCreate() (eventSet, ixml.Return) {
+	return &simulatedEventSet{served: make(map[*simulatedDevice]int)}, ixml.SUCCESS
+}
+
+// simulatedEventSet raises the 'xid' steps of the registered devices, one step
+// per Wait. Unlike a metric query, each step is raised once, a zero value is a
+// Wait without event.
+type simulatedEventSet struct {
+	mutex   sync.Mutex
+	devices []*simulatedDevice
+	served  map[*simulatedDevice]int
+}
+
+func (s *simulatedEventSet) Register(device gpuDevice) ixml.Return {
+	d, ok := device.(*simulatedDevice)
+	if !ok {
+		return ixml.ERROR_INVALID_ARGUMENT
+	}
+	if _, ok = d.config.Metrics[queryXid]; !ok {
+		return ixml.ERROR_NOT_SUPPORTED
+	}
+
+	s.mutex.Lock()
+	s.devices = append(s.devices, d)
+	s.mutex.Unlock()
+	return ixml.SUCCESS
+}
+
+func (s *simulatedEventSet) Wait(timeout time.Duration) (xidEvent, ixml.Return) {
+	device, step, ok := s.next()
+	if ok {
+		ret, _ := parseReturnCode(step.Ret)
+		if ret != ixml.SUCCESS {
+			return xidEvent{}, ret
+		}
+		if step.Value != 0 {
+			return xidEvent{uuid: device.config.UUID, xid: uint64(step.Value), timestamp: time.Now()}, ixml.SUCCESS
+		}
+	}
+
+	time.Sleep(timeout)
+	return xidEvent{}, ixml.ERROR_TIMEOUT
+}
+
+// next consumes the next 'xid' step of the first registered device which has one left.
+func (s *simulatedEventSet) next() (*simulatedDevice, config.ScenarioStep, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	for _, d := range s.devices {
+		steps := d.config.Metrics[queryXid]
+		index := s.served[d]
+		if index < len(steps) {
+			s.served[d]++
+			return d, steps[index], true
+		}
+	}
+	return nil, config.ScenarioStep{}, false
+}
+
+func (s *simulatedEventSet) Free() {}
+
+// simulatedDevice answers the queries of a collection cycle from the step of the
+// cycle, so the number of calls made by a cycle, e.g. one per violation policy, or
+// by an enumeration does not change the steps served.
+type simulatedDevice struct {
+	mutex  sync.Mutex
+	config *config.ScenarioDevice
+	cycle  int
+}
+
+// beginCycle moves every query to its step of the next cycle, the first cycle is
+// served the first step like the enumerations before it.
+func (d *simulatedDevice) beginCycle() {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	d.cycle++
+}
+
+// next returns the step of the given query for the current cycle.
+func (d *simulatedDevice) next(query string) (config.ScenarioStep, ixml.Return) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+
+	steps, ok := d.config.Metrics[query]
+	if !ok || len(steps) == 0 {
+		return config.ScenarioStep{}, ixml.ERROR_NOT_SUPPORTED
+	}
+
+	index := min(max(d.cycle-1, 0), len(steps)-1)
+	ret, _ := parseReturnCode(steps[index].Ret)
+	return steps[index], ret
+}
+
+func (d *simulatedDevice) GetName() (string, ixml.Return) {
+	return d.config.Name, ixml.SUCCESS
+}
+
+func (d *simulatedDevice) GetUUID() (string, ixml.Return) {
+	return d.config.UUID, ixml.SUCCESS
+}
+
+func (d *simulatedDevice) GetBoardPosition() (uint32, ixml.Return) {
+	if d.config.BoardPosition == nil {
+		return 0, ixml.ERROR_NOT_SUPPORTED
+	}
+	return *d.config.BoardPosition, ixml.SUCCESS
+}
+
+func (d *simulatedDevice) GetPciBusId() (string, ixml.Return) {
+	return simulatedText(d.config.PciBusId)
+}
+
+func (d *simulatedDevice) GetSerial() (string, ixml.Return) {
+	return simulatedText(d.config.Serial)
+}
+
+func (d *simulatedDevice) GetBoardPartNumber() (string, ixml.Return) {
+	return simulatedText(d.config.BoardPartNumber)
+}
+
+func (d *simulatedDevice) GetVbiosVersion() (string, ixml.Return) {
+	return simulatedText(d.config.VbiosVersion)
+}
+
+// simulatedText answers the static string queries, which are not supported when
+// missing from the scenario.
+func simulatedText(text string) (string, ixml.Return) {
+	if text == "" {
+		return "", ixml.ERROR_NOT_SUPPORTED
+	}
+	return text, ixml.SUCCESS
+}
+
+func (d *simulatedDevice) GetTemperature() (uint32, ixml.Return) {
+	step, ret := d.next(queryTemperature)
+	return uint32(step.Value), ret
+}
+
+func (d *simulatedDevice) GetFanSpeed() (uint32, ixml.Return) {
+	step, ret := d.next(queryFanSpeed)
+	return uint32(step.Value), ret
+}
+
+func (d *simulatedDevice) GetClockInfo() (clockInfo, ixml.Return) {
+	step, ret := d.next(queryClock)
+	return clockInfo{
+		sm:  uint32(step.Fields["sm"]),
+		mem: uint32(step.Fields["mem"]),
+	}, ret
+}
+
+func (d *simulatedDevice) GetMemoryInfo() (memoryInfo, ixml.Return) {
+	step, ret := d.next(queryMemory)
+	return memoryInfo{
+		total: uint64(step.Fields["total"]),
+		used:  uint64(step.Fields["used"]),
+		free:  uint64(step.Fields["free"]),
+	}, ret
+}
+
+func (d *simulatedDevice) GetPowerUsage() (uint32, ixml.Return) {
+	step, ret := d.next(queryPowerUsage)
+	return uint32(step.Value), ret
+}
+
+func (d *simulatedDevice) GetUtilizationRates() (utilizationInfo, ixml.Return) {
+	step, ret := d.next(queryUtilization)
+	return utilizationInfo{
+		gpu:    uint32(step.Fields["gpu"]),
+		memory: uint32(step.Fields["memory"]),
+	}, ret
+}
+
+func (d *simulatedDevice) GetComputeRunningProcesses() ([]processInfo, ixml.Return) {
+	step, ret := d.next(queryProcesses)
+	infos := make([]processInfo, 0, len(step.Processes))
+	for _, process := range step.Processes {
+		infos = append(infos, processInfo{
+			pid:           process.Pid,
+			usedGpuMemory: process.UsedMemory,
+		})
+	}
+	return infos, ret
+}
+
+func (d *simulatedDevice) GetCurrentClocksThrottleReasons() (uint64, ixml.Return) {
+	step, ret := d.next(queryThrottleReasons)
+	return uint64(step.Value), ret
+}
+
+// GetViolationTime answers from the 'violationTime' query, whose fields are keyed
+// by policy and in ns.
+func (d *simulatedDevice) GetViolationTime(policy violationPolicy) (uint64, ixml.Return) {
+	step, ret := d.next(queryViolationTime)
+	if ret != ixml.SUCCESS {
+		return 0, ret
+	}
+	value, ok := step.Fields[string(policy)]
+	if !ok {
+		return 0, ixml.ERROR_NOT_SUPPORTED
+	}
+	return uint64(value), ixml.SUCCESS
+}
+
+func (d *simulatedDevice) GetPcieThroughput() (pcieThroughput, ixml.Return) {
+	step, ret := d.next(queryPcieThroughput)
+	return pcieThroughput{
+		tx: uint32(step.Fields["tx"]),
+		rx: uint32(step.Fields["rx"]),
+	}, ret
+}
+
+func (d *simulatedDevice) GetPcieReplayCounter() (uint32, ixml.Return) {
+	step, ret := d.next(queryPcieReplay)
+	return uint32(step.Value), ret
+}
+
+func (d *simulatedDevice) GetPcieLinkInfo() (pcieLinkInfo, ixml.Return) {
+	step, ret := d.next(queryPcieLink)
+	return pcieLinkInfo{
+		currGeneration: uint32(step.Fields["currGen"]),
+		maxGeneration:  uint32(step.Fields["maxGen"]),
+		currWidth:      uint32(step.Fields["currWidth"]),
+		maxWidth:       uint32(step.Fields["maxWidth"]),
+	}, ret
+}
+
+func (d *simulatedDevice) GetEccErros() (uint64, uint64, ixml.Return) {
+	step, ret := d.next(queryEcc)
+	return uint64(step.Fields["sbe"]), uint64(step.Fields["dbe"]), ret
+}
+
+func (d *simulatedDevice) GpmQueryDeviceSupport() (bool, ixml.Return) {
+	step, ret := d.next(queryGpmSupport)
+	return step.Value != 0, ret
+}
+
+// simulatedGpmSample holds the 'gpm' step taken by GpmSampleGet, the metrics
+// between two samples are those of the step of the later one.
+type simulatedGpmSample struct {
+	step config.ScenarioStep
+}
+
+func (simulatedGpmSample) Free() {}
+
+func (d *simulatedDevice) GpmSampleGet() (gpmSample, ixml.Return) {
+	step, ret := d.next(queryGpm)
+	if ret != ixml.SUCCESS {
+		return nil, ret
+	}
+	return simulatedGpmSample{step: step}, ixml.SUCCESS
+}
+
+// GpmMetricGet answers from the fields of the 'gpm' step, keyed by metric id.
+func (d *simulatedDevice) GpmMetricGet(_, sample2 gpmSample, metricId uint32) (float64, ixml.Return) {
+	sample, ok := sample2.(simulatedGpmSample)
+	if !ok {
+		return 0, ixml.ERROR_INVALID_ARGUMENT
+	}
+	value, ok := sample.step.Fields[strconv.FormatUint(uint64(metricId), 10)]
+	if !ok {
+		return 0, ixml.ERROR_NOT_SUPPORTED
+	}
+	return value, ixml.SUCCESS
+}
@@ -0,0 +1,77 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+
+	"gitee.com/deep-spark/go-ixml/pkg/ixml"
+)
+
+func TestSimulatedDeviceStepPerCycle(t *testing.T) {
+	sb, err := newSimulatedBackend(filepath.Join("testdata", "scenario.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	device := sb.devices[0]
+
+	// The enumerations before the first cycle are served the first step, and do not
+	// move to the next one.
+	for i := 0; i < 3; i++ {
+		if memory, _ := device.GetMemoryInfo(); memory.used != 116 {
+			t.Fatalf("enumeration %d: used memory %d, want 116", i, memory.used)
+		}
+	}
+
+	cycles := []struct {
+		temperature uint32
+		used        uint64
+		power       uint64
+		thermal     uint64
+	}{
+		{31, 116, 0, 0},
+		{45, 1140, 1500000000, 250000000},
+		{52, 2164, 3000000000, 250000000},
+		{52, 2164, 3000000000, 250000000},
+	}
+	for i, want := range cycles {
+		device.beginCycle()
+		for call := 0; call < 2; call++ {
+			temperature, _ := device.GetTemperature()
+			memory, _ := device.GetMemoryInfo()
+			power, _ := device.GetViolationTime(violationPower)
+			thermal, _ := device.GetViolationTime(violationThermal)
+			got := fmt.Sprint(temperature, memory.used, power, thermal)
+			if expected := fmt.Sprint(want.temperature, want.used, want.power, want.thermal); got != expected {
+				t.Errorf("cycle %d call %d: got %s, want %s", i, call, got, expected)
+			}
+		}
+	}
+
+	if _, ret := sb.devices[1].GetViolationTime(violationPower); ret != ixml.ERROR_NOT_SUPPORTED {
+		t.Errorf("missing query returned %v, want ERROR_NOT_SUPPORTED", ret)
+	}
+}
+
+func TestSimulatedMetricsGolden(t *testing.T) {
+	for i, metrics := range collectCycles(t, &Options{}, 3) {
+		checkGolden(t, fmt.Sprintf("simulated_cycle%d.prom", i+1), metrics)
+	}
+}
@@ -0,0 +1,110 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// metricsSnapshot is the result of one collection of the gpu metrics, it is not
+// modified once stored.
+type metricsSnapshot struct {
+	metrics    map[string][]metric
+	timestamp  time.Time
+	generation uint64
+}
+
+// kubeSnapshot is the result of one collection of the kubernetes labels of the
+// GPUs, it is not modified once stored.
+type kubeSnapshot struct {
+	labels    map[string]labelType
+	timestamp time.Time
+}
+
+// snapshotStore keeps the last result of each subcollector. A result is swapped
+// in whole and never modified afterward, so that it is read without lock while
+// the subcollectors store the next ones.
+type snapshotStore struct {
+	gpu  atomic.Pointer[metricsSnapshot]
+	kube atomic.Pointer[kubeSnapshot]
+}
+
+func newSnapshotStore() *snapshotStore {
+	store := &snapshotStore{}
+	store.gpu.Store(&metricsSnapshot{metrics: make(map[string][]metric)})
+	store.kube.Store(&kubeSnapshot{labels: make(map[string]labelType)})
+	return store
+}
+
+func (s *snapshotStore) storeGpuMetrics(metrics map[string][]metric) {
+	for {
+		previous := s.gpu.Load()
+		snapshot := &metricsSnapshot{
+			metrics:    metrics,
+			timestamp:  time.Now(),
+			generation: previous.generation + 1,
+		}
+		if s.gpu.CompareAndSwap(previous, snapshot) {
+			return
+		}
+	}
+}
+
+func (s *snapshotStore) storeKubeLabels(labels map[string]labelType) {
+	s.kube.Store(&kubeSnapshot{labels: labels, timestamp: time.Now()})
+}
+
+// merged joins the last gpu metrics with the last kubernetes labels of their GPU,
+// the labels are merged into copies of the metrics.
+func (s *snapshotStore) merged() *metricsSnapshot {
+	snapshot := s.gpu.Load()
+	kube := s.kube.Load()
+	if len(kube.labels) == 0 {
+		return snapshot
+	}
+
+	merged := &metricsSnapshot{
+		metrics:    make(map[string][]metric, len(snapshot.metrics)),
+		timestamp:  snapshot.timestamp,
+		generation: snapshot.generation,
+	}
+	for uuid, ms := range snapshot.metrics {
+		labels, ok := kube.labels[uuid]
+		if !ok {
+			merged.metrics[uuid] = ms
+			continue
+		}
+
+		mergedMetrics := make([]metric, 0, len(ms))
+		for _, m := range ms {
+			mergedLabels := make(map[string]string, len(m.labels)+len(labels))
+			for key, value := range m.labels {
+				mergedLabels[key] = value
+			}
+			for key, value := range labels {
+				mergedLabels[key] = value
+			}
+			m.labels = mergedLabels
+			mergedMetrics = append(mergedMetrics, m)
+		}
+		merged.metrics[uuid] = mergedMetrics
+	}
+
+	return merged
+}
@@ -0,0 +1,98 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestSnapshotStoreMerged(t *testing.T) {
+	store := newSnapshotStore()
+	if snapshot := store.merged(); snapshot.generation != 0 || len(snapshot.metrics) != 0 {
+		t.Fatalf("empty store: got generation %d and %d GPUs", snapshot.generation, len(snapshot.metrics))
+	}
+
+	store.storeGpuMetrics(map[string][]metric{
+		"GPU-0": {{name: Temperature, value: 31, labels: map[string]string{LabelUuid: "GPU-0", LabelPod: ""}}},
+		"GPU-1": {{name: Temperature, value: 33, labels: map[string]string{LabelUuid: "GPU-1", LabelPod: ""}}},
+	})
+	store.storeKubeLabels(map[string]labelType{"GPU-0": {LabelPod: "train-0"}})
+
+	snapshot := store.merged()
+	if snapshot.generation != 1 {
+		t.Errorf("got generation %d, want 1", snapshot.generation)
+	}
+	if pod := snapshot.metrics["GPU-0"][0].labels[LabelPod]; pod != "train-0" {
+		t.Errorf("GPU-0: got pod %q, want train-0", pod)
+	}
+	if pod := snapshot.metrics["GPU-1"][0].labels[LabelPod]; pod != "" {
+		t.Errorf("GPU-1: got pod %q, want none", pod)
+	}
+	if pod := store.gpu.Load().metrics["GPU-0"][0].labels[LabelPod]; pod != "" {
+		t.Errorf("stored metrics modified by merged: got pod %q", pod)
+	}
+}
+
+// TestSnapshotStoreConcurrent stores and merges snapshots from several goroutines,
+// it is meant to run with -race.
+func TestSnapshotStoreConcurrent(t *testing.T) {
+	const writers, stores = 4, 100
+	store := newSnapshotStore()
+
+	var wg sync.WaitGroup
+	for w := 0; w < writers; w++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < stores; i++ {
+				store.storeGpuMetrics(map[string][]metric{
+					"GPU-0": {{name: Temperature, value: float64(i), labels: map[string]string{LabelPod: ""}}},
+				})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < stores; i++ {
+				store.storeKubeLabels(map[string]labelType{"GPU-0": {LabelPod: fmt.Sprintf("pod-%d", i)}})
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			var generation uint64
+			for i := 0; i < stores; i++ {
+				snapshot := store.merged()
+				if snapshot.generation < generation {
+					t.Errorf("generation went back from %d to %d", generation, snapshot.generation)
+				}
+				generation = snapshot.generation
+				for _, ms := range snapshot.metrics {
+					for _, m := range ms {
+						_ = m.labels[LabelPod]
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if generation := store.merged().generation; generation != writers*stores {
+		t.Errorf("got generation %d, want %d", generation, writers*stores)
+	}
+}
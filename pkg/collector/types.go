@@ -18,29 +18,68 @@ limitations under the License.
 package collector
 
 import (
-	"gitee.com/deep-spark/go-ixml/pkg/ixml"
+	"time"
 )
 
 type Options struct {
-	Loglevel      int64
-	Logfile       string
-	IP            string
-	Port          string
-	MetricsConfig string
-	EnableKube    bool
+	Loglevel             int64
+	Logfile              string
+	IP                   string
+	Port                 string
+	MetricsConfig        string
+	EnableKube           bool
+	SimulateConfig       string
+	ReplayFile           string
+	EnumerationInterval  time.Duration
+	CollectWorkers       int
+	DeviceTimeout        time.Duration
+	ReadErrorValue       string
+	PollInterval         time.Duration
+	SampleTimestamps     bool
+	CollectTimeout       time.Duration
+	MinCollectInterval   time.Duration
+	ConfigReloadInterval time.Duration
+	// MetricsEmbedded is set if MetricsConfig is an exporter config file which holds
+	// the metrics config.
+	MetricsEmbedded bool
+	// ConfigFile is the exporter config file, its settings other than the metrics
+	// config are applied at start only. Settings are the values it gave then to the
+	// flags set neither on the command line nor by environment variable, by flag
+	// name, and SettingNames the flags it can set.
+	ConfigFile      string
+	Settings        map[string]string
+	SettingNames    []string
+	KubeletSocket   string
+	ResourceName    string
+	KubeTimeout     time.Duration
+	ClusterConfig   string
+	MetricNamespace string
+	MetricNaming    string
+	// ConstLabels are added to every exported metric, as "name=value,name=value".
+	ConstLabels string
 }
 
 type iluvatarGPU struct {
+	initialized   bool
 	count         uint
 	driverVersion string
 	cudaVersion   string
+	ixmlVersion   string
 	gpus          map[string]gpuInfo
 	pairChips     map[string]string
+	// generation counts the enumerations stored in the gpuInventory, the handles
+	// of the devices may change with each one.
+	generation uint64
 }
 
 type gpuInfo struct {
 	index             uint
 	name              string
+	pciBusId          string
+	serial            string
+	boardPartNumber   string
+	vbiosVersion      string
+	boardPosition     string
 	temperature       float64
 	fanSpeed          float64
 	smClock           float64
@@ -57,8 +96,14 @@ type gpuInfo struct {
 }
 
 type collectorConfig struct {
-	Name string
-	Help string
+	Name          string
+	Help          string
+	Interval      time.Duration
+	OnEnumeration bool
+	ExportName    string
+	Type          string
+	Scale         float64
+	ConstLabels   map[string]string
 }
 
 type metric struct {
@@ -71,5 +116,5 @@ type labelType map[string]string
 
 type chip struct {
 	uuid      string
-	operation ixml.Device
+	operation gpuDevice
 }
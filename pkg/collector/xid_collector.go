@@ -0,0 +1,241 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"gitee.com/deep-spark/go-ixml/pkg/ixml"
+	"gitee.com/deep-spark/ixexporter/pkg/logger"
+)
+
+const (
+	xidLogSize         = 256
+	xidWaitTimeout     = time.Second
+	xidRegisterBackoff = time.Minute
+)
+
+// xidLog keeps the last xidLogSize XID events, and the last one of each GPU.
+type xidLog struct {
+	mutex  sync.RWMutex
+	events []xidEvent
+	next   int
+	last   map[string]xidEvent
+}
+
+func newXidLog() *xidLog {
+	return &xidLog{
+		events: make([]xidEvent, 0, xidLogSize),
+		last:   make(map[string]xidEvent),
+	}
+}
+
+func (xl *xidLog) add(event xidEvent) {
+	xl.mutex.Lock()
+	defer xl.mutex.Unlock()
+
+	if len(xl.events) < xidLogSize {
+		xl.events = append(xl.events, event)
+	} else {
+		xl.events[xl.next] = event
+	}
+	xl.next = (xl.next + 1) % xidLogSize
+	xl.last[event.uuid] = event
+}
+
+func (xl *xidLog) lastEvent(uuid string) (xidEvent, bool) {
+	xl.mutex.RLock()
+	defer xl.mutex.RUnlock()
+
+	event, ok := xl.last[uuid]
+	return event, ok
+}
+
+// recent returns the logged events of the GPU, oldest first.
+func (xl *xidLog) recent(uuid string) []xidEvent {
+	xl.mutex.RLock()
+	defer xl.mutex.RUnlock()
+
+	var events []xidEvent
+	for i := range xl.events {
+		event := xl.events[(xl.next+i)%len(xl.events)]
+		if event.uuid == uuid {
+			events = append(events, event)
+		}
+	}
+	return events
+}
+
+// xidCollector waits for the critical XID events of the enumerated GPUs, so that
+// the XIDs occurring between two scrapes are counted too.
+type xidCollector struct {
+	inventory *gpuInventory
+	backend   deviceBackend
+	metrics   *exporterMetrics
+	xids      *xidLog
+	set       eventSet
+	// devices are the handles of the GPUs of the event set, nil for a GPU whose
+	// handle could not be acquired, as of the generation of the enumeration.
+	devices    map[string]gpuDevice
+	generation uint64
+}
+
+func registerXidCollector(ctx *ixContext, inventory *gpuInventory, backend deviceBackend,
+	metrics *exporterMetrics, xids *xidLog) {
+	var collector subCollector
+
+	collector = &xidCollector{
+		inventory: inventory,
+		backend:   backend,
+		metrics:   metrics,
+		xids:      xids,
+	}
+	ctx.registerCollector(collector)
+}
+
+func (xc *xidCollector) collect(ctx *ixContext) {
+	defer xc.free()
+
+	for {
+		select {
+		case <-ctx.done():
+			return
+		default:
+		}
+
+		gpus := xc.inventory.get()
+		if !gpus.initialized {
+			xc.free()
+			sleepContext(ctx, xidWaitTimeout)
+			continue
+		}
+
+		if xc.set == nil || xc.enumerationChanged(gpus) {
+			if !xc.register(gpus) {
+				sleepContext(ctx, xidRegisterBackoff)
+				continue
+			}
+		}
+
+		event, ret := xc.set.Wait(xidWaitTimeout)
+		switch ret {
+		case ixml.SUCCESS:
+			xc.record(event, gpus)
+		case ixml.ERROR_TIMEOUT:
+		default:
+			// The event set is likely unusable, e.g. after a driver reload.
+			logger.IluvatarLog.Warningf("Unable to wait for XID events: %v", ret)
+			xc.free()
+			sleepContext(ctx, xidWaitTimeout)
+		}
+	}
+}
+
+// enumerationChanged reports whether the GPUs changed since the event set was
+// created. A GPU which was reset and enumerated again keeps its uuid, but the
+// events of its new handle are not delivered to the set, so the handles are
+// compared too once a new enumeration is stored.
+func (xc *xidCollector) enumerationChanged(gpus iluvatarGPU) bool {
+	if gpus.generation == xc.generation {
+		return false
+	}
+	if len(gpus.gpus) != len(xc.devices) {
+		return true
+	}
+	for uuid := range gpus.gpus {
+		registered, ok := xc.devices[uuid]
+		if !ok {
+			return true
+		}
+		device, ret := xc.backend.GetHandleByUUID(uuid)
+		if ret != ixml.SUCCESS {
+			device = nil
+		}
+		if device != registered {
+			return true
+		}
+	}
+	xc.generation = gpus.generation
+	return false
+}
+
+// register creates a new event set for the enumerated GPUs, it reports false if
+// the event set could not be created.
+func (xc *xidCollector) register(gpus iluvatarGPU) bool {
+	xc.free()
+
+	set, ret := xc.backend.EventSetCreate()
+	if ret != ixml.SUCCESS {
+		logger.IluvatarLog.Warningf("Unable to create XID event set: %v", ret)
+		return false
+	}
+
+	xc.devices = make(map[string]gpuDevice)
+	for uuid, gpu := range gpus.gpus {
+		// A GPU which does not support XID events is still remembered, so that the
+		// set is only created again when the enumeration changes.
+		xc.devices[uuid] = nil
+
+		device, ret := xc.backend.GetHandleByUUID(uuid)
+		if ret != ixml.SUCCESS {
+			logger.IluvatarLog.Warningf("Unable to get Handle of GPU %s: %v", uuid, ret)
+			continue
+		}
+		xc.devices[uuid] = device
+		if ret = set.Register(device); ret != ixml.SUCCESS {
+			logger.IluvatarLog.Warningf("Unable to register XID events of GPU %s (%s): %v", uuid, gpu.name, ret)
+		}
+	}
+
+	xc.set = set
+	xc.generation = gpus.generation
+	return true
+}
+
+func (xc *xidCollector) free() {
+	if xc.set != nil {
+		xc.set.Free()
+		xc.set = nil
+	}
+	xc.devices = nil
+}
+
+func (xc *xidCollector) record(event xidEvent, gpus iluvatarGPU) {
+	gpu, ok := gpus.gpus[event.uuid]
+	if !ok {
+		logger.IluvatarLog.Warningf("XID %d on unknown GPU %s", event.xid, event.uuid)
+		return
+	}
+	logger.IluvatarLog.Warningf("XID %d on GPU %s (%s)", event.xid, event.uuid, gpu.name)
+
+	xc.xids.add(event)
+
+	index := strconv.FormatUint(uint64(gpu.index), 10)
+	xc.metrics.xidErrors.WithLabelValues(index, gpu.name, event.uuid, strconv.FormatUint(event.xid, 10)).Inc()
+	xc.metrics.xidLastTimestamp.WithLabelValues(index, gpu.name, event.uuid).Set(float64(event.timestamp.Unix()))
+}
+
+// sleepContext sleeps for the duration or until the context is cancelled.
+func sleepContext(ctx *ixContext, d time.Duration) {
+	select {
+	case <-ctx.done():
+	case <-time.After(d):
+	}
+}
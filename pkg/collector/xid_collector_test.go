@@ -0,0 +1,71 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package collector
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestXidEnumerationChanged(t *testing.T) {
+	sb, err := newSimulatedBackend(filepath.Join("testdata", "scenario.yaml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	gpus, err := getDeviceInfo(sb)
+	if err != nil {
+		t.Fatal(err)
+	}
+	inventory := newGpuInventory(iluvatarGPU{})
+	inventory.set(gpus)
+
+	xc := &xidCollector{inventory: inventory, backend: sb, metrics: newExporterMetrics(&metricNaming{namespace: DefaultNamespace}), xids: newXidLog()}
+	if !xc.register(inventory.get()) {
+		t.Fatal("register failed")
+	}
+	if xc.enumerationChanged(inventory.get()) {
+		t.Error("changed without a new enumeration")
+	}
+
+	// An enumeration of the same GPUs with the same handles keeps the event set.
+	inventory.set(gpus)
+	if xc.enumerationChanged(inventory.get()) {
+		t.Error("changed by an enumeration of the same GPUs")
+	}
+
+	// A GPU which was reset is enumerated again with the same uuid and a new handle.
+	sb.devices[0] = &simulatedDevice{config: sb.devices[0].config}
+	inventory.set(gpus)
+	if !xc.enumerationChanged(inventory.get()) {
+		t.Error("not changed by a new handle of a GPU")
+	}
+
+	// A GPU which vanished.
+	xc.register(inventory.get())
+	remaining := make(map[string]gpuInfo)
+	for uuid, gpu := range gpus.gpus {
+		if uuid != sb.devices[1].config.UUID {
+			remaining[uuid] = gpu
+		}
+	}
+	gpus.gpus = remaining
+	inventory.set(gpus)
+	if !xc.enumerationChanged(inventory.get()) {
+		t.Error("not changed by a vanished GPU")
+	}
+}
@@ -0,0 +1,80 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"fmt"
+	"io"
+
+	"gopkg.in/yaml.v2"
+)
+
+// FixtureVersion is the version of the fixture files written and read.
+const FixtureVersion = "1"
+
+// FixtureCall is one recorded IXML query. Device is the uuid of the queried device,
+// empty for system level queries. Text holds string results, and the uuid of the
+// returned device for handle lookups.
+type FixtureCall struct {
+	Device     string             `yaml:"device,omitempty"`
+	Query      string             `yaml:"query"`
+	Args       []string           `yaml:"args,omitempty"`
+	Ret        string             `yaml:"ret"`
+	Value      float64            `yaml:"value,omitempty"`
+	Text       string             `yaml:"text,omitempty"`
+	Fields     map[string]float64 `yaml:"fields,omitempty"`
+	Processes  []ScenarioProcess  `yaml:"processes,omitempty"`
+	DurationNs int64              `yaml:"durationNs"`
+}
+
+// Fixture is a versioned struct holding the IXML queries recorded by 'ix-exporter record'.
+type Fixture struct {
+	Version string        `yaml:"version"`
+	Calls   []FixtureCall `yaml:"calls"`
+}
+
+func ParseFixtureFrom(reader io.Reader) (*Fixture, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("read error: %v", err)
+	}
+
+	var fixture Fixture
+	if err = yaml.Unmarshal(data, &fixture); err != nil {
+		return nil, fmt.Errorf("unmarshal error: %v", err)
+	}
+
+	if fixture.Version != FixtureVersion {
+		return nil, fmt.Errorf("unsupported fixture version '%s', expect '%s'", fixture.Version, FixtureVersion)
+	}
+
+	return &fixture, nil
+}
+
+func (f *Fixture) Save(writer io.Writer) error {
+	data, err := yaml.Marshal(f)
+	if err != nil {
+		return fmt.Errorf("marshal error: %v", err)
+	}
+
+	if _, err = writer.Write(data); err != nil {
+		return fmt.Errorf("write error: %v", err)
+	}
+
+	return nil
+}
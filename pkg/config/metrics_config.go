@@ -18,28 +18,134 @@ limitations under the License.
 package config
 
 import (
+	"bytes"
 	"errors"
+	"fmt"
+	"io"
 	"os"
+	"regexp"
+	"sort"
+	"strings"
 
 	"strconv"
+	"time"
 
 	"gitee.com/deep-spark/ixexporter/pkg/logger"
 	"gitee.com/deep-spark/ixexporter/pkg/utils"
-	yaml "gopkg.in/yaml.v2"
+	yaml "gopkg.in/yaml.v3"
+)
+
+// IntervalOnEnumeration is the interval of a metric read once per device
+// enumeration, for the metrics which do not change.
+const IntervalOnEnumeration = "on_enumeration"
+
+// Types of a metric, the type of the metric in the exporter is kept if empty.
+const (
+	MetricTypeGauge   = "gauge"
+	MetricTypeCounter = "counter"
+)
+
+var (
+	metricNameRE = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelNameRE  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	unitRE       = regexp.MustCompile(`^[a-zA-Z0-9_]+$`)
 )
 
 type MetricConfig struct {
 	Name string `yaml:"name"`
 	Help string `yaml:"help"`
+	// Interval is the minimum time between two reads of the metric from the device,
+	// e.g. "5m" or IntervalOnEnumeration, the metric is read at every collection
+	// if empty.
+	Interval string `yaml:"interval,omitempty"`
+	Type     string `yaml:"type,omitempty"`
+	// Unit is appended to the exported name, before the '_total' of a counter.
+	Unit string `yaml:"unit,omitempty"`
+	// Scale multiplies the value read from the device, 0 is the same as 1.
+	Scale   float64 `yaml:"scale,omitempty"`
+	Enabled *bool   `yaml:"enabled,omitempty"`
+	// Rename is the exported name of the metric instead of Name.
+	Rename string `yaml:"rename,omitempty"`
+	// Labels are constant labels added to every series of the metric.
+	Labels map[string]string `yaml:"labels,omitempty"`
+}
+
+// IsEnabled reports whether the metric is collected, a metric is enabled unless
+// disabled explicitly.
+func (mc MetricConfig) IsEnabled() bool {
+	return mc.Enabled == nil || *mc.Enabled
+}
+
+// ExportedName returns the name the metric is exported with, Name or Rename with
+// the unit.
+func (mc MetricConfig) ExportedName() string {
+	name := mc.Name
+	if mc.Rename != "" {
+		name = mc.Rename
+	}
+	if mc.Unit == "" {
+		return name
+	}
+
+	base, total := name, ""
+	if strings.HasSuffix(name, "_total") {
+		base, total = strings.TrimSuffix(name, "_total"), "_total"
+	}
+	if strings.HasSuffix(base, "_"+mc.Unit) {
+		return name
+	}
+	return base + "_" + mc.Unit + total
+}
+
+// ScaleFactor returns the factor of the values of the metric.
+func (mc MetricConfig) ScaleFactor() float64 {
+	if mc.Scale == 0 {
+		return 1
+	}
+	return mc.Scale
+}
+
+// CollectInterval parses the interval of the metric, it reports true if the metric
+// is read on enumeration.
+func (mc MetricConfig) CollectInterval() (time.Duration, bool, error) {
+	switch mc.Interval {
+	case "":
+		return 0, false, nil
+	case IntervalOnEnumeration:
+		return 0, true, nil
+	}
+
+	interval, err := time.ParseDuration(mc.Interval)
+	if err != nil || interval <= 0 {
+		return 0, false, fmt.Errorf("invalid interval '%s' of metric %s, expect a positive duration or '%s'",
+			mc.Interval, mc.Name, IntervalOnEnumeration)
+	}
+	return interval, false, nil
+}
+
+// ExpectedVersions are the versions of the driver stack a node should run, an
+// empty version is not checked.
+type ExpectedVersions struct {
+	Driver string `yaml:"driver,omitempty"`
+	Cuda   string `yaml:"cuda,omitempty"`
+	Ixml   string `yaml:"ixml,omitempty"`
 }
 
 type ExporterConfig struct {
-	Metrics []MetricConfig `yaml:"metrics"`
+	ExpectedVersions ExpectedVersions `yaml:"expectedVersions,omitempty"`
+	Metrics          []MetricConfig   `yaml:"metrics"`
 }
 
 type Config struct {
 	ConfigFile string
 	IxExporter map[string]ExporterConfig
+	// Sections are the top-level keys allowed in the config file and Metrics the
+	// names of the metrics which can be collected, they are not checked if empty.
+	Sections []string
+	Metrics  map[string]bool
+	// Embedded is set if ConfigFile is an exporter config file, which holds the
+	// metrics config under SettingsMetricsKey.
+	Embedded bool
 }
 
 func (c *Config) ParseConfig() error {
@@ -49,7 +155,7 @@ func (c *Config) ParseConfig() error {
 	}
 	if !exists {
 		logger.IluvatarLog.Errorf("file not found: %s", c.ConfigFile)
-		return err
+		return fmt.Errorf("file not found: %s", c.ConfigFile)
 	}
 
 	data, err := os.ReadFile(c.ConfigFile)
@@ -58,7 +164,7 @@ func (c *Config) ParseConfig() error {
 		return err
 	}
 
-	if err = yaml.Unmarshal(data, c.IxExporter); err != nil {
+	if err = c.decode(data); err != nil {
 		logger.IluvatarLog.Errorf("fail to parse config file: %s", c.ConfigFile)
 		return err
 	}
@@ -71,6 +177,131 @@ func (c *Config) ParseConfig() error {
 	return nil
 }
 
+// decode decodes the config strictly, every unknown key, unknown or duplicate
+// metric is reported with its line.
+func (c *Config) decode(data []byte) error {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return err
+	}
+	var sections *yaml.Node
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		sections = root.Content[0]
+		if c.Embedded {
+			sections = mappingValue(sections, SettingsMetricsKey)
+		}
+	}
+	errs := c.checkNames(sections)
+
+	// The other keys of an exporter config file are left to ParseSettings.
+	var embedded struct {
+		Sections map[string]ExporterConfig `yaml:"metrics"`
+		Settings map[string]yaml.Node      `yaml:",inline"`
+	}
+	var target interface{} = c.IxExporter
+	if c.Embedded {
+		embedded.Sections = c.IxExporter
+		target = &embedded
+	}
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(target); err != nil && err != io.EOF {
+		var typeErr *yaml.TypeError
+		if errors.As(err, &typeErr) {
+			for _, e := range typeErr.Errors {
+				errs = append(errs, errors.New(e))
+			}
+		} else {
+			errs = append(errs, err)
+		}
+	}
+
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errorLine(errs[i]) < errorLine(errs[j])
+	})
+	return errors.Join(errs...)
+}
+
+// errorLine returns the line of an error of decode, or 0.
+func errorLine(err error) int {
+	var line int
+	fmt.Sscanf(err.Error(), "line %d:", &line)
+	return line
+}
+
+// checkNames checks the sections and the metric names of the config, and the fields
+// of the metrics. The node maps the sections.
+func (c *Config) checkNames(node *yaml.Node) []error {
+	if node == nil || node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	var errs []error
+	sections := node.Content
+	for i := 0; i+1 < len(sections); i += 2 {
+		key, section := sections[i], sections[i+1]
+		if len(c.Sections) > 0 && !contains(c.Sections, key.Value) {
+			errs = append(errs, fmt.Errorf("line %d: unknown section '%s', expect one of %s",
+				key.Line, key.Value, strings.Join(c.Sections, ", ")))
+			continue
+		}
+
+		metrics := mappingValue(section, "metrics")
+		if metrics == nil || metrics.Kind != yaml.SequenceNode {
+			continue
+		}
+		lines := make(map[string]int)
+		for _, metric := range metrics.Content {
+			name := mappingValue(metric, "name")
+			if name == nil || name.Value == "" {
+				continue
+			}
+			if line, ok := lines[name.Value]; ok {
+				errs = append(errs, fmt.Errorf("line %d: duplicate metric '%s', first at line %d",
+					name.Line, name.Value, line))
+				continue
+			}
+			lines[name.Value] = name.Line
+			if len(c.Metrics) > 0 && !c.Metrics[name.Value] {
+				errs = append(errs, fmt.Errorf("line %d: unknown metric '%s'", name.Line, name.Value))
+			}
+
+			// A metric which can not be decoded is reported by the decoder.
+			var mc MetricConfig
+			if metric.Decode(&mc) != nil {
+				continue
+			}
+			if err := mc.verify(metric); err != nil {
+				errs = append(errs, err)
+			}
+		}
+	}
+	return errs
+}
+
+// mappingValue returns the value of the key in the mapping node, or nil.
+func mappingValue(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+	return nil
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Config) verifyIxExporterConfig() error {
 	for k, v := range c.IxExporter {
 		if k == "" || len(v.Metrics) == 0 {
@@ -88,3 +319,36 @@ func (c *Config) verifyIxExporterConfig() error {
 
 	return nil
 }
+
+// verify checks the fields of the metric, the error starts with the line of the
+// field in the node of the metric.
+func (mc MetricConfig) verify(node *yaml.Node) error {
+	line := func(key string) int {
+		if value := mappingValue(node, key); value != nil {
+			return value.Line
+		}
+		return node.Line
+	}
+
+	if _, _, err := mc.CollectInterval(); err != nil {
+		return fmt.Errorf("line %d: %w", line("interval"), err)
+	}
+	switch mc.Type {
+	case "", MetricTypeGauge, MetricTypeCounter:
+	default:
+		return fmt.Errorf("line %d: invalid type '%s' of metric %s, expect '%s' or '%s'",
+			line("type"), mc.Type, mc.Name, MetricTypeGauge, MetricTypeCounter)
+	}
+	if mc.Unit != "" && !unitRE.MatchString(mc.Unit) {
+		return fmt.Errorf("line %d: invalid unit '%s' of metric %s", line("unit"), mc.Unit, mc.Name)
+	}
+	if mc.Rename != "" && !metricNameRE.MatchString(mc.Rename) {
+		return fmt.Errorf("line %d: invalid rename '%s' of metric %s", line("rename"), mc.Rename, mc.Name)
+	}
+	for label := range mc.Labels {
+		if !labelNameRE.MatchString(label) || strings.HasPrefix(label, "__") {
+			return fmt.Errorf("line %d: invalid label name '%s' of metric %s", line("labels"), label, mc.Name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gitee.com/deep-spark/ixexporter/pkg/logger"
+)
+
+func TestMain(m *testing.M) {
+	logger.IluvatarLog = logger.NewIluvatarLog()
+	logger.IluvatarLog.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// parseMetricsConfig parses the metrics config of the data like the exporter, with
+// the section 'iluvatar' and the metrics ix_temperature and ix_power_usage.
+func parseMetricsConfig(t *testing.T, data string, embedded bool) (*Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "metrics.yaml")
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	c := &Config{
+		ConfigFile: path,
+		IxExporter: make(map[string]ExporterConfig),
+		Sections:   []string{"iluvatar"},
+		Metrics:    map[string]bool{"ix_temperature": true, "ix_power_usage": true},
+		Embedded:   embedded,
+	}
+	return c, c.ParseConfig()
+}
+
+func TestParseConfigStrict(t *testing.T) {
+	tests := []struct {
+		name     string
+		data     string
+		embedded bool
+		// errs are the errors expected in order, one per line of the error.
+		errs []string
+	}{
+		{
+			name: "valid",
+			data: `iluvatar:
+  metrics:
+  - name: ix_temperature
+    help: The temperature.
+    interval: 5m
+  - name: ix_power_usage
+    help: The power usage.
+    type: counter
+    unit: watts
+    rename: ix_power
+    labels: {site: lab}
+`,
+		},
+		{
+			name: "unknown field",
+			data: `iluvatar:
+  metrics:
+  - name: ix_temperature
+    help: The temperature.
+    intervall: 5m
+`,
+			errs: []string{"line 5: field intervall not found"},
+		},
+		{
+			name: "unknown section",
+			data: `iluvatar:
+  metrics:
+  - name: ix_temperature
+    help: The temperature.
+nvidia:
+  metrics: []
+`,
+			errs: []string{"line 5: unknown section 'nvidia', expect one of iluvatar"},
+		},
+		{
+			name: "unknown and duplicate metrics",
+			data: `iluvatar:
+  metrics:
+  - name: ix_temperature
+    help: The temperature.
+  - name: ix_temprature
+    help: The temperature.
+  - name: ix_temperature
+    help: The temperature.
+`,
+			errs: []string{
+				"line 5: unknown metric 'ix_temprature'",
+				"line 7: duplicate metric 'ix_temperature', first at line 3",
+			},
+		},
+		{
+			name: "errors sorted by line",
+			data: `iluvatar:
+  metrics:
+  - name: ix_temperature
+    help: The temperature.
+    color: red
+  - name: ix_fan
+    help: The fan.
+  expected: {}
+`,
+			errs: []string{
+				"line 5: field color not found",
+				"line 6: unknown metric 'ix_fan'",
+				"line 8: field expected not found",
+			},
+		},
+		{
+			name: "wrong type",
+			data: `iluvatar:
+  metrics:
+  - name: ix_temperature
+    help: The temperature.
+    scale: twice
+`,
+			errs: []string{"line 5: cannot unmarshal !!str `twice` into float64"},
+		},
+		{
+			name: "invalid yaml",
+			data: "iluvatar:\n  metrics: [\n",
+			errs: []string{"yaml: line 2"},
+		},
+		{
+			name: "invalid interval",
+			data: `iluvatar:
+  metrics:
+  - name: ix_temperature
+    help: The temperature.
+    interval: often
+`,
+			errs: []string{"line 5: invalid interval 'often' of metric ix_temperature"},
+		},
+		{
+			name: "invalid type",
+			data: `iluvatar:
+  metrics:
+  - name: ix_temperature
+    help: The temperature.
+    type: histogram
+`,
+			errs: []string{"line 5: invalid type 'histogram' of metric ix_temperature"},
+		},
+		{
+			name: "reserved label",
+			data: `iluvatar:
+  metrics:
+  - name: ix_temperature
+    help: The temperature.
+    labels: {__name__: x}
+`,
+			errs: []string{"line 5: invalid label name '__name__' of metric ix_temperature"},
+		},
+		{
+			name: "invalid fields of several metrics",
+			data: `iluvatar:
+  metrics:
+  - name: ix_temperature
+    help: The temperature.
+    rename: ix-temp
+    intervall: 5m
+  - name: ix_power_usage
+    help: The power usage.
+    unit: kilo watts
+`,
+			errs: []string{
+				"line 5: invalid rename 'ix-temp' of metric ix_temperature",
+				"line 6: field intervall not found",
+				"line 9: invalid unit 'kilo watts' of metric ix_power_usage",
+			},
+		},
+		{
+			name: "missing help",
+			data: `iluvatar:
+  metrics:
+  - name: ix_temperature
+`,
+			errs: []string{"miss field 'help'"},
+		},
+		{
+			name: "embedded",
+			data: `port: "32021"
+metrics:
+  iluvatar:
+    metrics:
+    - name: ix_temperature
+      help: The temperature.
+`,
+			embedded: true,
+		},
+		{
+			name: "embedded unknown field",
+			data: `port: "32021"
+metrics:
+  iluvatar:
+    metrics:
+    - name: ix_temperature
+      help: The temperature.
+      intervall: 5m
+      type: histogram
+  other: {}
+`,
+			embedded: true,
+			errs: []string{
+				"line 7: field intervall not found",
+				"line 8: invalid type 'histogram' of metric ix_temperature",
+				"line 9: unknown section 'other'",
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, err := parseMetricsConfig(t, tt.data, tt.embedded)
+			if len(tt.errs) == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if len(c.IxExporter["iluvatar"].Metrics) == 0 {
+					t.Error("no metric parsed")
+				}
+				return
+			}
+
+			if err == nil {
+				t.Fatalf("no error, want %q", tt.errs)
+			}
+			lines := strings.Split(err.Error(), "\n")
+			if len(lines) != len(tt.errs) {
+				t.Fatalf("got errors %q, want %q", lines, tt.errs)
+			}
+			for i, want := range tt.errs {
+				if !strings.Contains(lines[i], want) {
+					t.Errorf("error %d: got %q, want %q", i, lines[i], want)
+				}
+			}
+		})
+	}
+}
+
+func TestParseConfigMissingFile(t *testing.T) {
+	c := &Config{ConfigFile: filepath.Join(t.TempDir(), "missing.yaml"), IxExporter: make(map[string]ExporterConfig)}
+	if err := c.ParseConfig(); err == nil || !strings.Contains(err.Error(), "file not found") {
+		t.Errorf("got %v, want file not found", err)
+	}
+}
@@ -0,0 +1,113 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ScenarioVersion is the version of the scenario files read.
+const ScenarioVersion = "1"
+
+// ScenarioStep is the answer of one query. Value is used by single valued queries,
+// Fields by queries returning several values, e.g. 'memory' (total, used, free).
+// Ret is the IXML return code name, SUCCESS if empty.
+type ScenarioStep struct {
+	Value     float64            `yaml:"value"`
+	Fields    map[string]float64 `yaml:"fields,omitempty"`
+	Processes []ScenarioProcess  `yaml:"processes,omitempty"`
+	Ret       string             `yaml:"ret,omitempty"`
+}
+
+type ScenarioProcess struct {
+	Pid        uint32 `yaml:"pid"`
+	UsedMemory uint64 `yaml:"usedMemory"`
+}
+
+// ScenarioDevice describes one simulated GPU. Metrics maps a query name to the
+// steps returned by successive collection cycles, the last step is repeated once
+// exhausted.
+type ScenarioDevice struct {
+	Name            string                    `yaml:"name"`
+	UUID            string                    `yaml:"uuid"`
+	PciBusId        string                    `yaml:"pciBusId,omitempty"`
+	Serial          string                    `yaml:"serial,omitempty"`
+	BoardPartNumber string                    `yaml:"boardPartNumber,omitempty"`
+	VbiosVersion    string                    `yaml:"vbiosVersion,omitempty"`
+	BoardPosition   *uint32                   `yaml:"boardPosition,omitempty"`
+	Pair            string                    `yaml:"pair,omitempty"`
+	Metrics         map[string][]ScenarioStep `yaml:"metrics,omitempty"`
+}
+
+// Scenario is a versioned struct used to drive the simulated device backend.
+type Scenario struct {
+	Version       string           `yaml:"version"`
+	InitRet       string           `yaml:"initRet,omitempty"`
+	DriverVersion string           `yaml:"driverVersion"`
+	CudaVersion   string           `yaml:"cudaVersion"`
+	IxmlVersion   string           `yaml:"ixmlVersion"`
+	Devices       []ScenarioDevice `yaml:"devices"`
+}
+
+func ParseScenarioFrom(reader io.Reader) (*Scenario, error) {
+	data, err := io.ReadAll(reader)
+	if err != nil {
+		return nil, fmt.Errorf("read error: %v", err)
+	}
+
+	var scenario Scenario
+	if err = yaml.Unmarshal(data, &scenario); err != nil {
+		return nil, fmt.Errorf("unmarshal error: %v", err)
+	}
+
+	if err = scenario.verify(); err != nil {
+		return nil, err
+	}
+
+	return &scenario, nil
+}
+
+func (s *Scenario) verify() error {
+	if s.Version != ScenarioVersion {
+		return fmt.Errorf("unsupported scenario version '%s', expect '%s'", s.Version, ScenarioVersion)
+	}
+
+	uuids := make(map[string]bool)
+	for i, device := range s.Devices {
+		if device.UUID == "" {
+			return errors.New("miss field 'uuid' in 'devices' configuration of device" + strconv.Itoa(i))
+		}
+		if uuids[device.UUID] {
+			return fmt.Errorf("duplicate uuid '%s' in 'devices' configuration", device.UUID)
+		}
+		uuids[device.UUID] = true
+	}
+
+	for _, device := range s.Devices {
+		if device.Pair != "" && !uuids[device.Pair] {
+			return fmt.Errorf("pair '%s' of device '%s' not found", device.Pair, device.UUID)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,174 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+
+	yaml "gopkg.in/yaml.v3"
+)
+
+// SettingsVersion is the version of the exporter config file.
+const SettingsVersion = "v1"
+
+// Keys of the exporter config file besides the flags of the exporter.
+const (
+	SettingsVersionKey = "version"
+	SettingsMetricsKey = "metrics"
+	// MetricsConfigSetting is the flag of the metrics config file, it excludes the
+	// metrics config in the exporter config file.
+	MetricsConfigSetting = "metrics-config"
+)
+
+// Setting is the value of a flag of the exporter set in the exporter config file.
+type Setting struct {
+	Name  string
+	Value string
+	Line  int
+}
+
+// Settings is an exporter config file, it sets the flags of the exporter by their
+// name, and may hold the metrics config under SettingsMetricsKey:
+//
+//	version: v1
+//	port: "32021"
+//	kubelet-socket: /var/lib/kubelet/pod-resources/kubelet.sock
+//	metrics:
+//	  iluvatar:
+//	    metrics:
+//	      - name: ix_temperature
+//	        help: The temperature of the iluvatar GPU(C).
+type Settings struct {
+	Version    string
+	Values     []Setting
+	HasMetrics bool
+}
+
+// ParseSettings parses the exporter config file, names are the flags which can be
+// set in it. The errors are reported with their line.
+func ParseSettings(path string, names []string) (*Settings, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	if root.Kind != yaml.DocumentNode || len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("expect a mapping of the exporter settings")
+	}
+
+	settings := &Settings{}
+	var errs []error
+	metricsConfigLine := 0
+	lines := make(map[string]int)
+	mapping := root.Content[0]
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		key, value := mapping.Content[i], mapping.Content[i+1]
+		if line, ok := lines[key.Value]; ok {
+			errs = append(errs, fmt.Errorf("line %d: duplicate key '%s', first at line %d", key.Line, key.Value, line))
+			continue
+		}
+		lines[key.Value] = key.Line
+
+		switch {
+		case key.Value == SettingsVersionKey:
+			settings.Version = value.Value
+			if value.Value != SettingsVersion {
+				errs = append(errs, fmt.Errorf("line %d: unsupported version '%s', expect '%s'",
+					value.Line, value.Value, SettingsVersion))
+			}
+		case key.Value == SettingsMetricsKey:
+			if value.Kind != yaml.MappingNode {
+				errs = append(errs, fmt.Errorf("line %d: expect the metrics config under '%s'", value.Line, key.Value))
+				continue
+			}
+			settings.HasMetrics = true
+		case !contains(names, key.Value):
+			errs = append(errs, fmt.Errorf("line %d: unknown setting '%s'", key.Line, key.Value))
+		case value.Kind != yaml.ScalarNode:
+			errs = append(errs, fmt.Errorf("line %d: expect a single value for '%s'", value.Line, key.Value))
+		default:
+			if key.Value == MetricsConfigSetting {
+				metricsConfigLine = key.Line
+			}
+			settings.Values = append(settings.Values, Setting{Name: key.Value, Value: value.Value, Line: value.Line})
+		}
+	}
+
+	if settings.Version == "" {
+		errs = append(errs, fmt.Errorf("missing '%s', expect '%s'", SettingsVersionKey, SettingsVersion))
+	}
+	if settings.HasMetrics && metricsConfigLine > 0 {
+		errs = append(errs, fmt.Errorf("line %d: '%s' and '%s' are exclusive",
+			metricsConfigLine, MetricsConfigSetting, SettingsMetricsKey))
+	}
+
+	sort.SliceStable(errs, func(i, j int) bool {
+		return errorLine(errs[i]) < errorLine(errs[j])
+	})
+	return settings, errors.Join(errs...)
+}
+
+// FormatSettings formats the settings as an exporter config file, the values are
+// written in the order of names. The metrics config is written under
+// SettingsMetricsKey unless nil, with a comment of its source.
+func FormatSettings(names []string, values map[string]interface{}, metrics map[string]ExporterConfig,
+	source string) ([]byte, error) {
+	mapping := &yaml.Node{Kind: yaml.MappingNode}
+	add := func(key string, value interface{}) error {
+		var node yaml.Node
+		if err := node.Encode(value); err != nil {
+			return fmt.Errorf("invalid value of '%s': %v", key, err)
+		}
+		mapping.Content = append(mapping.Content, &yaml.Node{Kind: yaml.ScalarNode, Value: key}, &node)
+		return nil
+	}
+
+	if err := add(SettingsVersionKey, SettingsVersion); err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if err := add(name, values[name]); err != nil {
+			return nil, err
+		}
+	}
+	if metrics != nil {
+		if err := add(SettingsMetricsKey, metrics); err != nil {
+			return nil, err
+		}
+		mapping.Content[len(mapping.Content)-2].HeadComment = "loaded from " + source
+	}
+
+	var b strings.Builder
+	encoder := yaml.NewEncoder(&b)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(mapping); err != nil {
+		return nil, err
+	}
+	if err := encoder.Close(); err != nil {
+		return nil, err
+	}
+	return []byte(b.String()), nil
+}
@@ -20,6 +20,7 @@ package server
 import (
 	"context"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
@@ -36,14 +37,20 @@ type MetricsServer struct {
 	server *http.Server
 }
 
-func NewMetricsServer(opts *collector.Options, reg *prometheus.Registry) *MetricsServer {
+// ScrapeCollector is a collector whose collection is bound to the context of a
+// scrape.
+type ScrapeCollector interface {
+	WithContext(ctx context.Context) prometheus.Collector
+}
+
+func NewMetricsServer(opts *collector.Options, reg *prometheus.Registry, sc ScrapeCollector) *MetricsServer {
 
 	mServer := &MetricsServer{
 		server: &http.Server{
 			Addr:           opts.IP + ":" + opts.Port,
 			Handler:        http.DefaultServeMux,
 			ReadTimeout:    10 * time.Second,
-			WriteTimeout:   10 * time.Second,
+			WriteTimeout:   collector.MetricsWriteTimeout,
 			MaxHeaderBytes: http.DefaultMaxHeaderBytes,
 		},
 	}
@@ -65,15 +72,47 @@ func NewMetricsServer(opts *collector.Options, reg *prometheus.Registry) *Metric
 		},
 	))
 
-	http.Handle("/metrics", promhttp.HandlerFor(reg,
-		promhttp.HandlerOpts{
-			ErrorHandling: promhttp.ContinueOnError,
-		}),
-	)
+	http.Handle("/metrics", http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), scrapeTimeout(r, opts.CollectTimeout))
+			defer cancel()
+
+			// The collector is registered for this scrape only, so that it collects
+			// within the timeout of the scrape.
+			scrapeReg := prometheus.NewRegistry()
+			if err := scrapeReg.Register(sc.WithContext(ctx)); err != nil {
+				logger.IluvatarLog.Errorf("Register scrape collector error: %v", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+
+			promhttp.HandlerFor(prometheus.Gatherers{reg, scrapeReg},
+				promhttp.HandlerOpts{
+					ErrorHandling: promhttp.ContinueOnError,
+				}).ServeHTTP(w, r)
+		},
+	))
 
 	return mServer
 }
 
+// scrapeTimeout returns the timeout sent by Prometheus in the X-Prometheus-Scrape-Timeout-Seconds
+// header, bounded by the collect timeout. The collector keeps its own margin out of
+// it to send the metrics in time.
+func scrapeTimeout(r *http.Request, collectTimeout time.Duration) time.Duration {
+	header := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds")
+	if header == "" {
+		return collectTimeout
+	}
+
+	seconds, err := strconv.ParseFloat(header, 64)
+	if err != nil || seconds <= 0 {
+		logger.IluvatarLog.Warningf("Invalid X-Prometheus-Scrape-Timeout-Seconds %q, ignore it", header)
+		return collectTimeout
+	}
+	return min(time.Duration(seconds*float64(time.Second)), collectTimeout)
+}
+
 func (ms *MetricsServer) Run(ctx context.Context, cancel context.CancelFunc) {
 	logger.IluvatarLog.Infof("Metrics server is running on %s", ms.server.Addr)
 	go func() {
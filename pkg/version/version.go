@@ -0,0 +1,30 @@
+/*
+Copyright (c) 2024, Shanghai Iluvatar CoreX Semiconductor Co., Ltd.
+All Rights Reserved.
+
+Licensed under the Apache License, Version 2.0 (the "License"); you may
+not use this file except in compliance with the License. You may obtain
+a copy of the License at
+
+http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package version holds the build information of the exporter, Version and Commit
+// are set at build time with '-ldflags "-X ..."', see Makefile.
+package version
+
+import "runtime"
+
+var (
+	Version = "unknown"
+	Commit  = "unknown"
+)
+
+// GoVersion is the version of the Go toolchain which built the exporter.
+var GoVersion = runtime.Version()